@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// askRequest is a question for a model, sent to /api/ask or over the
+// WebSocket.
+type askRequest struct {
+	Chat      string   // hex ID of the chat, or "new"
+	Question  string   // may be empty if files are attached
+	Model     string   // empty means the chat's, or the registry's default for new chats
+	Files     []string // hex IDs of the uploads to attach
+	RequestID string   // the client's, passed back in the hub's message event
+	Conn      *hubConn // the WebSocket it was sent over, which follows the answer; nil over HTTP
+
+	// Rewind answers again from the message with the hex ID At of an
+	// existing chat, instead of after its leaf, in a new branch beside it.
+	Rewind rewind
+	At     string
+}
+
+// rewind is how a question takes the chat back to an earlier message.
+type rewind int
+
+const (
+	rewindNone       rewind = iota
+	rewindEdit              // the question is an alternative to the one At, keeping its attachments
+	rewindRegenerate        // the question of the reply At is answered again
+)
+
+// askError is a question refused before anything was generated, with the
+// HTTP status for it.
+type askError struct {
+	Status  int
+	Message string
+}
+
+func (e *askError) Error() string {
+	return e.Message
+}
+
+// startAsk saves a user's question and starts generating the answer. The
+// question is saved right away, new chats included, and the answer once it's
+// done, by a generation that carries on if the user loses their connection.
+// It also returns a warning if the conversation looks too long for the
+// model. Errors are *askError.
+func startAsk(user *User, req askRequest) (*generation, string, error) {
+	// Fiber's strings only last as long as the request, and the chat and its
+	// generation outlive it.
+	req.Chat, req.Question, req.Model = strings.Clone(req.Chat), strings.Clone(req.Question), strings.Clone(req.Model)
+	req.RequestID, req.At = strings.Clone(req.RequestID), strings.Clone(req.At)
+
+	chosenModel := req.Model
+	if chosenModel == "" {
+		chosenModel = registry.Default
+	}
+	newChat := req.Chat == "" || req.Chat == "new"
+
+	chat := &Chat{ID: primitive.NewObjectID()}
+
+	if !newChat {
+		objID, err := ObjectIDFromHex(req.Chat)
+		if err != nil {
+			return nil, "", &askError{fiber.StatusNotFound, "an unknown error occured"}
+		}
+
+		chat, err = chats.Get(ctx, objID)
+		if err == ErrNotFound {
+			return nil, "", &askError{fiber.StatusNotFound, "not found"}
+		}
+		if err != nil {
+			return nil, "", &askError{fiber.StatusInternalServerError, "an unknown error occured"}
+		}
+
+		if chat.User != user.ID {
+			return nil, "", &askError{fiber.StatusForbidden, "forbidden"}
+		}
+	}
+
+	// Answers are saved over the history they started from, so the chat is
+	// reserved for this one before it's read for good: an answer that
+	// finished since it was looked up has saved its reply by now. The
+	// generation stops when the user stops it, with the reply's ID, or when
+	// nobody has followed it for a while.
+	reply := newMessage("model")
+	genCtx, cancel := context.WithCancel(ctx)
+	g := newGeneration(reply.ID, user.ID, chat.ID, cancel)
+	if err := generations.tryAdd(g); err != nil {
+		g.finish()
+		cancel()
+		return nil, "", &askError{fiber.StatusConflict, err.Error()}
+	}
+	started := false
+	defer func() {
+		if !started {
+			generations.remove(g.id)
+			g.finish()
+			cancel()
+		}
+	}()
+
+	if !newChat {
+		var err error
+		chat, err = chats.Get(ctx, chat.ID)
+		if err == ErrNotFound {
+			return nil, "", &askError{fiber.StatusNotFound, "not found"}
+		}
+		if err != nil {
+			return nil, "", &askError{fiber.StatusInternalServerError, "an unknown error occured"}
+		}
+
+		// Any model can take a chat over, being sent its whole branch.
+		if req.Model == "" {
+			chosenModel = chat.Model
+		}
+	}
+
+	config, model, ok := registry.Get(chosenModel)
+	if !ok {
+		return nil, "", &askError{fiber.StatusForbidden, "invalid model"}
+	}
+	reply.Model = chosenModel
+
+	// The question follows the message parent, which is the chat's leaf
+	// unless it rewinds.
+	parent := chat.Leaf
+	var at, message Message
+	var kept []MessagePart
+	if req.Rewind != rewindNone {
+		id, err := ObjectIDFromHex(req.At)
+		found := false
+		if err == nil && !newChat {
+			at, found = chat.message(id)
+		}
+
+		switch req.Rewind {
+		case rewindEdit:
+			if !found || at.Role != "user" {
+				return nil, "", &askError{fiber.StatusBadRequest, "no question to edit there"}
+			}
+			parent = at.Parent
+			for _, part := range at.Parts {
+				if part.Type == PartFile {
+					kept = append(kept, part)
+				}
+			}
+		case rewindRegenerate:
+			var ok bool
+			if found && at.Role == "model" {
+				message, ok = chat.message(at.Parent)
+			}
+			if !ok || message.Role != "user" {
+				return nil, "", &askError{fiber.StatusBadRequest, "no answer to regenerate there"}
+			}
+			parent = message.Parent
+		}
+	}
+	history := chat.pathTo(parent)
+
+	if req.Rewind != rewindRegenerate {
+		parts, err := attachmentParts(ctx, user.ID, req.Files)
+		if err != nil {
+			return nil, "", &askError{fiber.StatusBadRequest, "attachment not found"}
+		}
+		parts = append(kept, parts...)
+		if req.Question != "" {
+			parts = append(parts, textPart(req.Question))
+		}
+		if len(parts) == 0 {
+			return nil, "", &askError{fiber.StatusBadRequest, "empty message"}
+		}
+		message = newMessage("user", parts...)
+	}
+
+	// The model gets the attached files' contents, the chat keeps
+	// references to them.
+	thread, err := expandAttachments(ctx, config, append(slices.Clone(history), message))
+	if errors.Is(err, ErrUnsupportedAttachment) {
+		return nil, "", &askError{fiber.StatusBadRequest, err.Error()}
+	}
+	if err != nil {
+		return nil, "", &askError{fiber.StatusInternalServerError, "an unknown error occured"}
+	}
+	warning := strings.TrimSpace(attachmentWarning(config, history) + " " + contextWarning(config, thread))
+
+	loc, _ := time.LoadLocation(TIMEZONE)
+	now := time.Now().In(loc)
+
+	var title string
+	if newChat {
+		title, err = generateTitle(ctx, titleTopic(message))
+		if err != nil {
+			log.Printf("Error generating title: %v", err)
+			return nil, "", &askError{fiber.StatusInternalServerError, "an unknown error occured"}
+		}
+	}
+
+	// If nothing gets generated, the chat is put back as it was. A
+	// regenerated answer gets a sibling under the question it had.
+	previous := *chat
+	if req.Rewind == rewindRegenerate {
+		chat.Leaf = message.ID
+	} else {
+		chat.Leaf = parent
+		chat.add(message)
+	}
+	if newChat {
+		chat = &Chat{
+			ID:       chat.ID,
+			User:     user.ID,
+			Title:    title,
+			Messages: chat.Messages,
+			Leaf:     chat.Leaf,
+			Model:    chosenModel,
+		}
+	}
+
+	if newChat {
+		err = chats.Create(ctx, chat)
+	} else {
+		err = chats.UpdateMessages(ctx, chat.ID, chat.Messages, chat.Leaf)
+	}
+	// The next question goes to the model picked for this one.
+	if err == nil && !newChat && chat.Model != chosenModel {
+		chat.Model = chosenModel
+		err = chats.SetModel(ctx, chat.ID, chosenModel)
+	}
+	if err != nil {
+		return nil, "", &askError{fiber.StatusInternalServerError, "an unknown error occured"}
+	}
+	started = true
+
+	meta := fiber.Map{"chatId": chat.ID.Hex(), "messageId": reply.ID.Hex(), "questionId": message.ID.Hex(), "model": chosenModel}
+	if newChat {
+		meta["title"] = title
+	}
+	g.emit(EventMeta, meta)
+
+	// Every tab the user has open shows the question, and those showing the
+	// chat follow the answer.
+	if newChat {
+		hub.broadcast(user.ID, fiber.Map{"type": HubChatCreated, "chatId": chat.ID.Hex(), "title": title}, nil)
+	}
+	hub.started(g, req.Conn, fiber.Map{
+		"type":      HubMessage,
+		"requestId": req.RequestID,
+		"chatId":    chat.ID.Hex(),
+		"messageId": reply.ID.Hex(),
+		"parent":    hexOrEmpty(parent),
+		"model":     chosenModel,
+		"message":   message,
+		"warning":   warning,
+	})
+
+	cs := model.StartChat(chatOptions(now), thread[:len(thread)-1])
+	go g.run(genCtx, cs, thread[len(thread)-1], chat, reply, previous, newChat)
+
+	return g, warning, nil
+}
+
+// streamAsk answers a question over HTTP, streaming the answer's events as
+// /api/ask does.
+func streamAsk(c *fiber.Ctx, user *User, req askRequest) error {
+	g, warning, err := startAsk(user, req)
+	var askErr *askError
+	if errors.As(err, &askErr) {
+		return c.Status(askErr.Status).SendString("error: " + askErr.Message)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("error: an unknown error occured")
+	}
+	if warning != "" {
+		c.Set("X-Context-Warning", warning)
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+
+	c.Response().SetBodyStreamWriter(func(w *bufio.Writer) {
+		(&eventStream{w: w}).follow(g, 0)
+	})
+
+	return nil
+}
+
+// handleEditMessage adds the request's "question" as an alternative to the
+// question in the URL, keeping its attachments and adding the ones in
+// "files", and answers it. The old question and its answers stay in their
+// own branch.
+func handleEditMessage(c *fiber.Ctx) error {
+	return handleRewind(c, rewindEdit)
+}
+
+// handleRegenerate answers again the question of the reply in the URL, in a
+// new branch beside it.
+func handleRegenerate(c *fiber.Ctx) error {
+	return handleRewind(c, rewindRegenerate)
+}
+
+func handleRewind(c *fiber.Ctx, how rewind) error {
+	user, err := apiUser(c)
+	if user == nil {
+		return err
+	}
+
+	return streamAsk(c, user, askRequest{
+		Chat:      c.Params("id"),
+		Question:  c.FormValue("question"),
+		Model:     c.FormValue("model"),
+		Files:     formValues(c, "files"),
+		RequestID: c.FormValue("requestId"),
+		Rewind:    how,
+		At:        c.Params("message"),
+	})
+}
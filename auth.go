@@ -1,13 +1,10 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func handleJoinPage(c *fiber.Ctx) error {
@@ -39,14 +36,6 @@ func handleJoin(c *fiber.Ctx) error {
 		)
 	}
 
-	result := users.FindOne(ctx, bson.M{"email": email})
-	if err := result.Err(); err == nil { //Check if a user with this email already exists
-		return c.Render(
-			"join",
-			fiber.Map{"Error": "A user with this student ID already exists"},
-		)
-	}
-
 	ret, err := verifier.Verify(email)
 	if err != nil || !ret.Syntax.Valid {
 		return c.Render(
@@ -70,13 +59,17 @@ func handleJoin(c *fiber.Ctx) error {
 		)
 	}
 
-	_, err = users.InsertOne(ctx, bson.D{
-		{Key: "studentID", Value: studentID},
-		{Key: "email", Value: email},
-		{Key: "name", Value: name},
-		{Key: "jtis", Value: []string{}},
-		{Key: "emailVerified", Value: false},
+	err = users.Create(ctx, &User{
+		StudentID:     studentID,
+		Email:         email,
+		Name:          name,
+		JTI:           []string{},
+		EmailVerified: false,
 	})
+	var duplicate *DuplicateError
+	if errors.As(err, &duplicate) {
+		return c.Render("join", fiber.Map{"Error": duplicateUserMessage(duplicate)})
+	}
 	if err != nil {
 		return c.Render(
 			"join",
@@ -97,6 +90,19 @@ func handleJoin(c *fiber.Ctx) error {
 	)
 }
 
+// duplicateUserMessage tells someone joining which of their details already
+// belong to an account.
+func duplicateUserMessage(duplicate *DuplicateError) string {
+	switch duplicate.Field {
+	case "email":
+		return "A user with this email already exists"
+	case "studentID":
+		return "A user with this student ID already exists"
+	default:
+		return "An account with these details already exists"
+	}
+}
+
 func handleLoginPage(c *fiber.Ctx) error {
 	token := c.Cookies("token", "")
 
@@ -124,18 +130,13 @@ func handleLogin(c *fiber.Ctx) error {
 		)
 	}
 
-	result := users.FindOne(
-		ctx, bson.D{{Key: "email", Value: email}},
-	)
-	if result.Err() == mongo.ErrNoDocuments { // user doesn't exist
+	user, err := users.ByEmail(ctx, email)
+	if err == ErrNotFound { // user doesn't exist
 		return c.Render(
 			"login",
 			fiber.Map{"Error": "Incorrect email address"},
 		)
 	}
-
-	var user User
-	err := users.FindOne(context.TODO(), bson.M{"email": email}).Decode(&user)
 	if err != nil {
 		return c.Render(
 			"login",
@@ -174,8 +175,7 @@ func handleVerificationPage(c *fiber.Ctx) error {
 		return c.SendString("not found")
 	}
 
-	result := emailVerification.FindOne(ctx, bson.M{"_id": objID})
-	if result.Err() == mongo.ErrNoDocuments { // verification doesn't exist
+	if _, err := emailVerification.Get(ctx, objID); err != nil { // verification doesn't exist
 		return c.SendString("not found")
 	}
 
@@ -191,26 +191,16 @@ func handleVerification(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	var verification Verification
-	err = emailVerification.FindOne(ctx, bson.M{"_id": objID}).Decode(&verification)
+	verification, err := emailVerification.Get(ctx, objID)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if err == ErrNotFound {
 			return c.SendStatus(fiber.StatusNotFound)
 		}
 		return c.Status(fiber.StatusInternalServerError).SendString("Database error")
 	}
 
 	if otp == verification.Code {
-		_, err := emailVerification.DeleteOne(ctx, bson.D{{Key: "_id", Value: objID}})
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("Database error")
-		}
-
-		_, err = users.UpdateOne(
-			ctx,
-			bson.M{"email": verification.Code},
-			bson.M{"$set": bson.M{"emailVerified": true}},
-		)
+		err := emailVerification.Delete(ctx, objID)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).SendString("Database error")
 		}
@@ -226,15 +216,7 @@ func handleVerification(c *fiber.Ctx) error {
 			Expires: time.Now().Add(time.Hour * 24 * 28),
 		})
 
-		_, err = users.UpdateOne(
-			ctx,
-			bson.M{"email": verification.Email},
-			bson.D{
-				{Key: "$push", Value: bson.D{{Key: "jtis", Value: jti}}},
-				{Key: "$set", Value: bson.D{{Key: "emailVerified", Value: true}}},
-			},
-			options.Update().SetUpsert(true),
-		)
+		err = users.AddToken(ctx, verification.Email, jti)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).SendString("an unknown error")
 		}
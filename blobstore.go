@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BlobStore keeps file contents under the hex SHA-256 of their bytes, so
+// identical uploads share one blob. Blobs carry no owner: File records and
+// chat messages reference them, and collectGarbage removes the ones nothing
+// references anymore.
+type BlobStore interface {
+	// Put stores the contents of r and returns their key and size. Putting
+	// contents that are already stored only refreshes the blob's time.
+	Put(ctx context.Context, r io.Reader) (key string, size int64, err error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// Walk calls fn with the key of every blob and when it was last put.
+	Walk(ctx context.Context, fn func(key string, modTime time.Time) error) error
+}
+
+// localBlobStore keeps blobs on disk, sharded into directories by the first
+// two bytes of their key: root/ab/cd/abcd....
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(root string) *localBlobStore {
+	return &localBlobStore{root: root}
+}
+
+// validBlobKey reports whether key is a hex SHA-256, which also keeps keys
+// from escaping the store's directory.
+func validBlobKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+func (s *localBlobStore) path(key string) string {
+	return filepath.Join(s.root, key[0:2], key[2:4], key)
+}
+
+func (s *localBlobStore) Put(ctx context.Context, r io.Reader) (string, int64, error) {
+	tmpDir := filepath.Join(s.root, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return "", 0, err
+	}
+
+	tmp, err := os.CreateTemp(tmpDir, "upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	key := hex.EncodeToString(h.Sum(nil))
+	path := s.path(key)
+
+	// Already stored: refresh the time so the garbage collector's grace
+	// period covers the File record that is about to reference it.
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return key, size, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, err
+	}
+
+	return key, size, nil
+}
+
+func (s *localBlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !validBlobKey(key) {
+		return nil, ErrNotFound
+	}
+
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return f, err
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, key string) error {
+	if !validBlobKey(key) {
+		return ErrNotFound
+	}
+
+	err := os.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+func (s *localBlobStore) Walk(ctx context.Context, fn func(key string, modTime time.Time) error) error {
+	shards, err := filepath.Glob(filepath.Join(s.root, "[0-9a-f][0-9a-f]", "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		entries, err := os.ReadDir(shard)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if !validBlobKey(entry.Name()) {
+				continue
+			}
+
+			info, err := entry.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := fn(entry.Name(), info.ModTime()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// blobGracePeriod keeps new blobs from being collected before the File
+// record referencing them has been written.
+const blobGracePeriod = time.Hour
+
+const blobGCInterval = 6 * time.Hour
+
+// gcRequests asks runGarbageCollector for a collection before the next
+// interval. Requests made while one is pending are merged into it.
+var gcRequests = make(chan struct{}, 1)
+
+// requestGC schedules a garbage collection, such as after files are deleted.
+func requestGC() {
+	select {
+	case gcRequests <- struct{}{}:
+	default:
+	}
+}
+
+// runGarbageCollector collects unreferenced blobs every interval and when
+// requested.
+func runGarbageCollector(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-gcRequests:
+		}
+
+		deleted, err := collectGarbage(ctx, blobGracePeriod, false)
+		if err != nil {
+			log.Printf("Error collecting unreferenced files: %v", err)
+			continue
+		}
+		if len(deleted) > 0 {
+			log.Printf("Deleted %d unreferenced files", len(deleted))
+		}
+	}
+}
+
+// runGC implements "geminui gc".
+func runGC(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list the blobs that would be deleted without deleting them")
+	grace := flags.Duration("grace", blobGracePeriod, "keep unreferenced blobs newer than this")
+	flags.Parse(args)
+
+	deleted, err := collectGarbage(ctx, *grace, *dryRun)
+	for _, key := range deleted {
+		fmt.Println(key)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Printf("%d unreferenced blobs would be deleted.\n", len(deleted))
+	} else {
+		fmt.Printf("Deleted %d unreferenced blobs.\n", len(deleted))
+	}
+	return nil
+}
+
+// blobRefs counts the references to every blob from File records and chat
+// messages.
+func blobRefs(ctx context.Context) (map[string]int, error) {
+	refs, err := uploads.BlobRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chatRefs, err := chats.BlobRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for key, n := range chatRefs {
+		refs[key] += n
+	}
+
+	return refs, nil
+}
+
+// collectGarbage deletes the blobs that no File record or chat message
+// references, skipping blobs put within the grace period. With dryRun set it
+// only reports what it would delete.
+func collectGarbage(ctx context.Context, grace time.Duration, dryRun bool) ([]string, error) {
+	// Mark before sweeping: a blob put after the refs were counted is newer
+	// than the grace period and is left alone.
+	refs, err := blobRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var garbage []string
+	cutoff := time.Now().Add(-grace)
+	err = blobs.Walk(ctx, func(key string, modTime time.Time) error {
+		if refs[key] == 0 && modTime.Before(cutoff) {
+			garbage = append(garbage, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return garbage, nil
+	}
+
+	for i, key := range garbage {
+		if err := blobs.Delete(ctx, key); err != nil && !errors.Is(err, ErrNotFound) {
+			return garbage[:i], err
+		}
+	}
+
+	return garbage, nil
+}
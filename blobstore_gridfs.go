@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// gridfsBlobStore keeps blobs in a MongoDB GridFS bucket, one file per blob
+// named by its key, so every instance sharing the database sees the same
+// uploads.
+type gridfsBlobStore struct {
+	bucket *gridfs.Bucket
+}
+
+// gridfsTempPrefix starts the names files are uploaded under until their key
+// is known.
+const gridfsTempPrefix = "tmp-"
+
+// isGridFSTemp reports whether name is a temporary upload's.
+func isGridFSTemp(name string) bool {
+	id, ok := strings.CutPrefix(name, gridfsTempPrefix)
+	return ok && primitive.IsValidObjectID(id)
+}
+
+func newGridFSBlobStore(db *mongo.Database) (*gridfsBlobStore, error) {
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName("blobs"))
+	if err != nil {
+		return nil, err
+	}
+	return &gridfsBlobStore{bucket: bucket}, nil
+}
+
+func (s *gridfsBlobStore) Put(ctx context.Context, r io.Reader) (string, int64, error) {
+	// The key is only known once the contents are read, so upload under a
+	// temporary name and rename the file afterwards. Walk reports temporary
+	// names too, so that the garbage collector removes the ones left behind
+	// by an instance that stopped in between.
+	h := sha256.New()
+	tmpID, err := s.bucket.UploadFromStream(gridfsTempPrefix+primitive.NewObjectID().Hex(), io.TeeReader(r, h))
+	if err != nil {
+		return "", 0, err
+	}
+
+	var tmp struct {
+		Length int64 `bson:"length"`
+	}
+	if err := s.bucket.GetFilesCollection().FindOne(ctx, bson.M{"_id": tmpID}).Decode(&tmp); err != nil {
+		return "", 0, err
+	}
+
+	key := hex.EncodeToString(h.Sum(nil))
+
+	// Already stored: drop the copy and refresh the time so the garbage
+	// collector's grace period covers the File record about to reference it.
+	result, err := s.bucket.GetFilesCollection().UpdateMany(ctx,
+		bson.M{"filename": key},
+		bson.M{"$set": bson.M{"uploadDate": time.Now()}},
+	)
+	if err != nil {
+		return "", 0, err
+	}
+	if result.MatchedCount > 0 {
+		if err := s.bucket.DeleteContext(ctx, tmpID); err != nil {
+			return "", 0, err
+		}
+		return key, tmp.Length, nil
+	}
+
+	if err := s.bucket.RenameContext(ctx, tmpID, key); err != nil {
+		return "", 0, err
+	}
+
+	return key, tmp.Length, nil
+}
+
+func (s *gridfsBlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !validBlobKey(key) {
+		return nil, ErrNotFound
+	}
+
+	stream, err := s.bucket.OpenDownloadStreamByName(key)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// Delete removes every file stored under key: two instances putting the same
+// new contents at once can each rename their upload to it. Temporary uploads
+// can be deleted by their name.
+func (s *gridfsBlobStore) Delete(ctx context.Context, key string) error {
+	if !validBlobKey(key) && !isGridFSTemp(key) {
+		return ErrNotFound
+	}
+
+	cursor, err := s.bucket.FindContext(ctx, bson.M{"filename": key})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	found := false
+	for cursor.Next(ctx) {
+		var file struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.Decode(&file); err != nil {
+			return err
+		}
+		if err := s.bucket.DeleteContext(ctx, file.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return err
+		}
+		found = true
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Walk also reports temporary uploads, by their name. Nothing references
+// them, so the garbage collector deletes them once they're older than its
+// grace period, which uploads still in progress aren't.
+func (s *gridfsBlobStore) Walk(ctx context.Context, fn func(key string, modTime time.Time) error) error {
+	cursor, err := s.bucket.FindContext(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	seen := map[string]bool{}
+	for cursor.Next(ctx) {
+		var file struct {
+			Name       string    `bson:"filename"`
+			UploadDate time.Time `bson:"uploadDate"`
+		}
+		if err := cursor.Decode(&file); err != nil {
+			return err
+		}
+		if !validBlobKey(file.Name) && !isGridFSTemp(file.Name) || seen[file.Name] {
+			continue
+		}
+		seen[file.Name] = true
+
+		if err := fn(file.Name, file.UploadDate); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
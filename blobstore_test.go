@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalBlobStoreDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	store := newLocalBlobStore(root)
+
+	key, size, err := store.Put(ctx, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"; key != want || size != 5 {
+		t.Fatalf("got key %s size %d, want %s size 5", key, size, want)
+	}
+	if _, err := os.Stat(filepath.Join(root, "2c", "f2", key)); err != nil {
+		t.Errorf("blob isn't stored in its shard: %v", err)
+	}
+
+	again, _, err := store.Put(ctx, strings.NewReader("hello"))
+	if err != nil || again != key {
+		t.Fatalf("putting the same contents again got %s, %v", again, err)
+	}
+
+	var keys []string
+	store.Walk(ctx, func(key string, modTime time.Time) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if !slices.Equal(keys, []string{key}) {
+		t.Errorf("store holds %v, want only %s", keys, key)
+	}
+
+	r, err := store.Open(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" {
+		t.Errorf("read %q", data)
+	}
+
+	if _, err := store.Open(ctx, "../../etc/passwd"); err != ErrNotFound {
+		t.Errorf("opening an invalid key got %v, want ErrNotFound", err)
+	}
+}
+
+func TestCollectGarbageKeepsReferencedBlobs(t *testing.T) {
+	newTestApp(t)
+	ctx := context.Background()
+
+	put := func(content string) string {
+		key, _, err := blobs.Put(ctx, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	byFile := put("referenced by a file")
+	byChat := put("referenced by a chat")
+	orphan := put("referenced by nothing")
+
+	if err := uploads.Create(ctx, &File{Name: "a.txt", Blob: byFile}); err != nil {
+		t.Fatal(err)
+	}
+	chat := &Chat{}
+	chat.add(newMessage("user", MessagePart{Type: PartFile, Name: "b.txt", Blob: byChat}))
+	if err := chats.Create(ctx, chat); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything is within the grace period.
+	deleted, err := collectGarbage(ctx, time.Hour, false)
+	if err != nil || len(deleted) != 0 {
+		t.Fatalf("collected %v, %v within the grace period", deleted, err)
+	}
+
+	deleted, err = collectGarbage(ctx, -time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(deleted, []string{orphan}) {
+		t.Errorf("collected %v, want only %s", deleted, orphan)
+	}
+
+	for _, key := range []string{byFile, byChat} {
+		if _, err := blobs.Open(ctx, key); err != nil {
+			t.Errorf("referenced blob %s: %v", key, err)
+		}
+	}
+}
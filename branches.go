@@ -0,0 +1,167 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A chat's messages form a tree: each message answers or follows its Parent,
+// and editing a question or regenerating an answer adds a sibling instead of
+// replacing it. The chat shows one branch at a time, the path from a root to
+// its Leaf.
+
+// Turn is a message of a chat's active branch, with the alternatives to it.
+type Turn struct {
+	Message
+	// Siblings are the IDs of the messages sharing its parent, itself
+	// included, oldest first.
+	Siblings []primitive.ObjectID
+	Index    int // of the message in Siblings
+}
+
+// Previous and Next return the IDs of the alternatives on either side of the
+// turn's message, or a zero ID if there's none.
+func (t Turn) Previous() primitive.ObjectID {
+	if t.Index == 0 {
+		return primitive.NilObjectID
+	}
+	return t.Siblings[t.Index-1]
+}
+
+func (t Turn) Next() primitive.ObjectID {
+	if t.Index+1 >= len(t.Siblings) {
+		return primitive.NilObjectID
+	}
+	return t.Siblings[t.Index+1]
+}
+
+// add appends messages to the active branch, each following the one before,
+// and makes the last one the leaf.
+func (c *Chat) add(messages ...Message) {
+	for _, message := range messages {
+		message.Parent = c.Leaf
+		c.Messages = append(c.Messages, message)
+		c.Leaf = message.ID
+	}
+}
+
+// message returns the message with an ID.
+func (c *Chat) message(id primitive.ObjectID) (Message, bool) {
+	for _, message := range c.Messages {
+		if message.ID == id {
+			return message, true
+		}
+	}
+	return Message{}, false
+}
+
+// Path returns the active branch, from its root to the leaf.
+func (c *Chat) Path() []Message {
+	return c.pathTo(c.Leaf)
+}
+
+// pathTo returns the messages from a root to the one with an ID, which is
+// empty if there's no such message.
+func (c *Chat) pathTo(id primitive.ObjectID) []Message {
+	byID := make(map[primitive.ObjectID]Message, len(c.Messages))
+	for _, message := range c.Messages {
+		byID[message.ID] = message
+	}
+
+	var path []Message
+	for message, ok := byID[id]; ok && len(path) < len(c.Messages); message, ok = byID[message.Parent] {
+		path = append(path, message)
+		if message.Parent.IsZero() {
+			break
+		}
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// Turns returns the active branch along with the alternatives to each of its
+// messages.
+func (c *Chat) Turns() []Turn {
+	children := make(map[primitive.ObjectID][]primitive.ObjectID)
+	for _, message := range c.Messages {
+		children[message.Parent] = append(children[message.Parent], message.ID)
+	}
+
+	path := c.Path()
+	turns := make([]Turn, len(path))
+	for i, message := range path {
+		siblings := children[message.Parent]
+		turns[i] = Turn{Message: message, Siblings: siblings}
+		for j, id := range siblings {
+			if id == message.ID {
+				turns[i].Index = j
+			}
+		}
+	}
+	return turns
+}
+
+// leafUnder returns the newest message in the subtree of the message with an
+// ID, which is where the branch through it was left.
+func (c *Chat) leafUnder(id primitive.ObjectID) primitive.ObjectID {
+	under := map[primitive.ObjectID]bool{id: true}
+	leaf := id
+	// Messages come after their parent, so one pass finds the whole subtree.
+	for _, message := range c.Messages {
+		if under[message.Parent] {
+			under[message.ID] = true
+			leaf = message.ID
+		}
+	}
+	return leaf
+}
+
+// fork copies the messages from a root to the one with an ID into a new chat
+// of the same user, as its only branch. The copies get new IDs, so that each
+// message is in one chat. It returns false if there's no such message.
+func (c *Chat) fork(id primitive.ObjectID) (*Chat, bool) {
+	path := c.pathTo(id)
+	if len(path) == 0 {
+		return nil, false
+	}
+
+	fork := &Chat{User: c.User, Title: c.Title, Model: c.Model}
+	for _, message := range path {
+		message.ID = primitive.NewObjectID()
+		fork.add(message)
+	}
+	return fork, true
+}
+
+// linkHistory turns a flat history, as chats before schema version 3 have,
+// into a single branch.
+func linkHistory(history []Message) ([]Message, primitive.ObjectID) {
+	var chat Chat
+	chat.add(history...)
+	return chat.Messages, chat.Leaf
+}
+
+// UnmarshalBSON reads chats from before schema version 3, which have a flat
+// history instead of messages, as a single branch.
+func (c *Chat) UnmarshalBSON(data []byte) error {
+	type plain Chat
+	if err := bson.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	if c.SchemaVersion >= 3 {
+		return nil
+	}
+
+	var legacy struct {
+		History []Message `bson:"history"`
+	}
+	if err := bson.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	upgradeHistory(legacy.History, c.ID.Timestamp())
+	c.Messages, c.Leaf = linkHistory(legacy.History)
+	return nil
+}
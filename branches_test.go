@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestChatBranches(t *testing.T) {
+	question, answer := newMessage("user", textPart("hi")), newMessage("model", textPart("hello"))
+	chat := &Chat{}
+	chat.add(question, answer)
+
+	// An edited question and its answer, beside the original.
+	chat.Leaf = primitive.NilObjectID
+	edited, reply := newMessage("user", textPart("hey")), newMessage("model", textPart("hey there"))
+	chat.add(edited, reply)
+
+	turns := chat.Turns()
+	if len(turns) != 2 || turns[0].ID != edited.ID || turns[1].ID != reply.ID {
+		t.Fatalf("got turns %+v, want the edited branch", turns)
+	}
+	if turns[0].Index != 1 || turns[0].Previous() != question.ID || !turns[0].Next().IsZero() {
+		t.Errorf("edited question is %d of %v", turns[0].Index, turns[0].Siblings)
+	}
+	if len(turns[1].Siblings) != 1 || !turns[1].Previous().IsZero() {
+		t.Errorf("reply has siblings %v, want none", turns[1].Siblings)
+	}
+
+	if leaf := chat.leafUnder(question.ID); leaf != answer.ID {
+		t.Errorf("branch through the original question ends at %s, want %s", leaf.Hex(), answer.ID.Hex())
+	}
+	chat.Leaf = answer.ID
+	if path := chat.Path(); len(path) != 2 || path[0].ID != question.ID || path[1].ID != answer.ID {
+		t.Errorf("got path %+v, want the original branch", path)
+	}
+}
+
+func TestLegacyHistoryIsOneBranch(t *testing.T) {
+	history := []Message{newMessage("user", textPart("hi")), newMessage("model", textPart("hello"))}
+	data, err := bson.Marshal(bson.M{"_id": primitive.NewObjectID(), "history": history, "schemaVersion": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chat Chat
+	if err := bson.Unmarshal(data, &chat); err != nil {
+		t.Fatal(err)
+	}
+	path := chat.Path()
+	if len(path) != 2 || path[0].ID != history[0].ID || path[1].Parent != history[0].ID || chat.Leaf != history[1].ID {
+		t.Errorf("got messages %+v and leaf %s, want the history as a branch", chat.Messages, chat.Leaf.Hex())
+	}
+}
+
+func TestSQLChatTrees(t *testing.T) {
+	ctx := context.Background()
+	db, err := openSQL(ctx, "sqlite:"+filepath.Join(t.TempDir(), "geminui.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	user := &User{Email: "student@example.com", StudentID: "1"}
+	if err := (&sqlUserStore{db: db}).Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	store := &sqlChatStore{db: db}
+
+	chat := &Chat{User: user.ID}
+	question := newMessage("user", textPart("hi"))
+	chat.add(question, newMessage("model", textPart("hello")))
+	if err := store.Create(ctx, chat); err != nil {
+		t.Fatal(err)
+	}
+	original := chat.Leaf
+
+	chat.Leaf = question.ID
+	chat.add(newMessage("model", textPart("hello again")))
+	if err := store.UpdateMessages(ctx, chat.ID, chat.Messages, chat.Leaf); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetLeaf(ctx, chat.ID, original); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get(ctx, chat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	turns := got.Turns()
+	if len(turns) != 2 || turns[0].ID != question.ID || turns[1].ID != original || len(turns[1].Siblings) != 2 {
+		t.Errorf("got messages %+v and leaf %s", got.Messages, got.Leaf.Hex())
+	}
+
+	// Chats saved before schema version 3 are a single branch.
+	_, err = db.exec(ctx, `UPDATE chats SET schema_version = 2, leaf = '' WHERE id = ?`, chat.ID.Hex())
+	if err == nil {
+		_, err = db.exec(ctx, `UPDATE messages SET parent = '' WHERE chat_id = ?`, chat.ID.Hex())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := upgradeSQLChatTrees(ctx, db, 10)
+	if err != nil || n != 1 {
+		t.Fatalf("upgraded %d chats, %v", n, err)
+	}
+	got, err = store.Get(ctx, chat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := got.Path(); got.SchemaVersion != 3 || len(path) != 3 || path[2].ID != chat.Messages[2].ID {
+		t.Errorf("upgraded chat has messages %+v and leaf %s, want them in one branch", got.Messages, got.Leaf.Hex())
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const titleInstruction = "You are a title generator for conversations between humans. Create concise, engaging, and relevant titles based on the provided conversation content. Do not provide titles in Markdown. Do not return multiple responses. Do not provide anything related to that it is a conversation. Do not answer or reply to the initial statement."
+
+// chatOptions builds the per-request options for a chat, which tell the model
+// the current time.
+func chatOptions(now time.Time) ChatOptions {
+	return ChatOptions{
+		SystemInstruction: "The current time is " + now.Format(time.Kitchen) + " on " + now.Format(time.DateOnly) + ".",
+	}
+}
+
+// generateTitle asks the summarizer model for a short title for a new chat.
+func generateTitle(ctx context.Context, question string) (string, error) {
+	response, err := registry.SummarizerModel().GenerateContent(
+		ctx,
+		ChatOptions{SystemInstruction: titleInstruction},
+		"Write a max 5 word title for an AI chat with this as the first question: "+question,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(response), nil
+}
+
+// titleTopic is what a chat's title is generated from when message is its
+// question: the question's text, or the names of its attachments.
+func titleTopic(message Message) string {
+	if text := message.Text(); text != "" {
+		return text
+	}
+
+	var names []string
+	for _, part := range message.Parts {
+		if part.Name != "" {
+			names = append(names, part.Name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// ownedChat looks up the user's chat in the URL's "id", or writes a JSON
+// error and returns nil. Other users' chats are reported as not found, like
+// missing ones, so that chat IDs can't be probed.
+func ownedChat(c *fiber.Ctx, user *User) (*Chat, error) {
+	objID, err := ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "chat not found"})
+	}
+
+	chat, err := chats.Get(ctx, objID)
+	if err == nil && chat.User != user.ID {
+		err = ErrNotFound
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "chat not found"})
+	}
+	if err != nil {
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured"})
+	}
+
+	return chat, nil
+}
+
+// handleRenameChat renames one of the user's chats to the request's "title",
+// in every tab they have open.
+func handleRenameChat(c *fiber.Ctx) error {
+	user, err := apiUser(c)
+	if user == nil {
+		return err
+	}
+
+	var body struct {
+		Title string `json:"title" form:"title"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request"})
+	}
+
+	title := strings.TrimSpace(body.Title)
+	if title == "" || len(title) > 255 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "titles must be 1 to 255 characters"})
+	}
+
+	chat, err := ownedChat(c, user)
+	if chat == nil {
+		return err
+	}
+
+	err = chats.Rename(ctx, chat.ID, title)
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "chat not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured"})
+	}
+
+	hub.broadcast(user.ID, fiber.Map{"type": HubChatRenamed, "chatId": chat.ID.Hex(), "title": title}, nil)
+
+	return c.JSON(fiber.Map{"ok": "chat renamed successfully", "id": chat.ID.Hex(), "title": title})
+}
+
+// handleSelectBranch shows the branch of one of the user's chats through the
+// message in the URL, where it was left, in every tab they have open.
+func handleSelectBranch(c *fiber.Ctx) error {
+	user, err := apiUser(c)
+	if user == nil {
+		return err
+	}
+
+	chat, err := ownedChat(c, user)
+	if chat == nil {
+		return err
+	}
+
+	id, err := ObjectIDFromHex(c.Params("message"))
+	if err == nil {
+		_, ok := chat.message(id)
+		if !ok {
+			err = ErrNotFound
+		}
+	}
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "message not found"})
+	}
+
+	// An answer being generated saves the chat's branch as it was when it
+	// started, over this one.
+	if _, busy := generations.forChat(chat.ID); busy {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "an answer is still being generated in this chat"})
+	}
+
+	leaf := chat.leafUnder(id)
+	if err := chats.SetLeaf(ctx, chat.ID, leaf); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured"})
+	}
+
+	hub.broadcast(user.ID, fiber.Map{"type": HubBranchSelected, "chatId": chat.ID.Hex(), "leaf": leaf.Hex()}, nil)
+
+	return c.JSON(fiber.Map{"ok": "branch selected", "leaf": leaf.Hex()})
+}
+
+// handleForkChat copies one of the user's chats, up to and including the
+// message in the URL, into a new chat with the request's "title" and
+// "model". The title defaults to one generated for the fork, and the model
+// to the chat's.
+func handleForkChat(c *fiber.Ctx) error {
+	user, err := apiUser(c)
+	if user == nil {
+		return err
+	}
+
+	var body struct {
+		Title string `json:"title" form:"title"`
+		Model string `json:"model" form:"model"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request"})
+	}
+
+	chat, err := ownedChat(c, user)
+	if chat == nil {
+		return err
+	}
+
+	id, err := ObjectIDFromHex(c.Params("message"))
+	var fork *Chat
+	ok := false
+	if err == nil {
+		fork, ok = chat.fork(id)
+	}
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "message not found"})
+	}
+
+	title := strings.TrimSpace(body.Title)
+	if len(title) > 255 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "titles must be 1 to 255 characters"})
+	}
+	if title == "" {
+		title, err = forkTitle(chat, fork)
+		if err != nil {
+			log.Printf("Error generating title: %v", err)
+		}
+	}
+	fork.Title = title
+
+	if body.Model != "" {
+		if _, _, ok := registry.Get(body.Model); !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid model"})
+		}
+		fork.Model = body.Model
+	}
+
+	if err := chats.Create(ctx, fork); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured"})
+	}
+
+	hub.broadcast(user.ID, fiber.Map{"type": HubChatCreated, "chatId": fork.ID.Hex(), "title": fork.Title}, nil)
+
+	return c.JSON(fiber.Map{"ok": "chat forked successfully", "id": fork.ID.Hex(), "title": fork.Title, "model": fork.Model})
+}
+
+// forkTitle generates a title for a fork of chat from the last question it
+// keeps, which is where it goes its own way. If that fails, it's the chat's
+// title marked as a fork.
+func forkTitle(chat, fork *Chat) (string, error) {
+	fallback := chat.Title
+	if len(fallback) <= 248 {
+		fallback += " (fork)"
+	}
+
+	path := fork.Path()
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i].Role != "user" {
+			continue
+		}
+		title, err := generateTitle(ctx, titleTopic(path[i]))
+		if err != nil || title == "" {
+			return fallback, err
+		}
+		return title, nil
+	}
+
+	return fallback, nil
+}
+
+// handleModelWarning tells the user, before they switch one of their chats
+// to the model in the "model" query parameter, about the attachments in its
+// branch that the model can't read. The warning is empty if there are none.
+func handleModelWarning(c *fiber.Ctx) error {
+	user, err := apiUser(c)
+	if user == nil {
+		return err
+	}
+
+	chat, err := ownedChat(c, user)
+	if chat == nil {
+		return err
+	}
+
+	config, _, ok := registry.Get(c.Query("model"))
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid model"})
+	}
+
+	return c.JSON(fiber.Map{"model": config.ID, "warning": attachmentWarning(config, chat.Path())})
+}
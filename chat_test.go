@@ -0,0 +1,1213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestApp wires the app to in-memory stores and the fake provider, and
+// returns it along with a login token for a verified user.
+func newTestApp(t *testing.T) (*fiber.App, string) {
+	t.Helper()
+
+	SECRET = "test-secret"
+	users = newMemoryUserStore()
+	chats = newMemoryChatStore()
+	uploads = newMemoryFileStore()
+	emailVerification = newMemoryVerificationStore()
+	blobs = newLocalBlobStore(t.TempDir())
+
+	config := filepath.Join(t.TempDir(), "models.json")
+	err := os.WriteFile(config, []byte(`{
+		"default": "fake",
+		"summarizer": "fake",
+		"models": [{"id": "fake", "name": "Fake", "backend": "fake", "enabled": true}]
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry, err = loadModelRegistry(config, map[string]Provider{"fake": &fakeProvider{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{Email: "student@example.com", Name: "Student"}
+	if err := users.Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	token, jti, err := generateJWT(user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.AddToken(context.Background(), user.Email, jti); err != nil {
+		t.Fatal(err)
+	}
+
+	return newApp(), token
+}
+
+// ask sends a question and returns the answer put together from the
+// response's delta events.
+func ask(t *testing.T, app *fiber.App, token, chatID, question string) string {
+	t.Helper()
+
+	status, body := askForm(t, app, token, chatID, url.Values{"question": {question}})
+	if status != fiber.StatusOK {
+		t.Errorf("POST /api/ask: %d: %s", status, body)
+	}
+
+	var answer string
+	for _, event := range parseEvents(t, body) {
+		if event.Name == EventDelta {
+			answer += event.Data["text"].(string)
+		}
+	}
+	return answer
+}
+
+type sseEvent struct {
+	ID   string
+	Name string
+	Data map[string]any
+}
+
+// parseEvents splits an event stream into its events, skipping comments.
+func parseEvents(t *testing.T, body string) []sseEvent {
+	t.Helper()
+
+	var events []sseEvent
+	for _, block := range strings.Split(body, "\n\n") {
+		var event sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			if id, ok := strings.CutPrefix(line, "id: "); ok {
+				event.ID = id
+			}
+			if name, ok := strings.CutPrefix(line, "event: "); ok {
+				event.Name = name
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				if err := json.Unmarshal([]byte(data), &event.Data); err != nil {
+					t.Errorf("event %q has invalid data: %v", event.Name, err)
+				}
+			}
+		}
+		if event.Name != "" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func askForm(t *testing.T, app *fiber.App, token, chatID string, form url.Values) (int, string) {
+	t.Helper()
+
+	return postForm(t, app, token, "/api/ask?chat="+chatID, form)
+}
+
+// postForm posts a form and returns the response's status and body.
+func postForm(t *testing.T, app *fiber.App, token, path string, form url.Values) (int, string) {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", "token="+token)
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Error(err)
+		return 0, ""
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func TestConcurrentAsksKeepTheirOwnOptions(t *testing.T) {
+	model := (&fakeProvider{}).Model("fake", GenerationConfig{})
+	start := time.Date(2024, time.December, 1, 8, 0, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(now time.Time) {
+			defer wg.Done()
+
+			opts := chatOptions(now)
+			answer, err := readStream(model.StartChat(opts, nil).SendMessageStream(context.Background(), newMessage("user", textPart("what time is it?"))))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if want := opts.SystemInstruction + "\nwhat time is it?"; answer != want {
+				t.Errorf("got answer %q, want %q", answer, want)
+			}
+		}(start.Add(time.Duration(i) * time.Minute))
+	}
+	wg.Wait()
+}
+
+func TestConcurrentAsks(t *testing.T) {
+	app, token := newTestApp(t)
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(question string) {
+			defer wg.Done()
+
+			answer := ask(t, app, token, "new", question)
+			if !strings.HasPrefix(answer, "The current time is ") || !strings.HasSuffix(answer, "\n"+question) {
+				t.Errorf("got answer %q to question %q", answer, question)
+			}
+		}(fmt.Sprintf("question %d", i))
+	}
+	wg.Wait()
+
+	user, err := users.ByEmail(context.Background(), "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatList, err := chats.ListByUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chatList) != n {
+		t.Fatalf("got %d chats, want %d", len(chatList), n)
+	}
+	for _, chat := range chatList {
+		if path := chat.Path(); len(path) != 2 || path[0].Role != "user" || path[1].Role != "model" {
+			t.Errorf("chat %s has messages %v", chat.ID.Hex(), path)
+		}
+	}
+}
+
+func TestAskWithAttachments(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(name, mimeType, content string) *File {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		file := &File{User: user.ID, Name: name, Path: path, MIMEType: mimeType, Size: int64(len(content))}
+		if err := uploads.Create(ctx, file); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	notes := upload("notes.txt", "text/plain; charset=utf-8", "mitochondria is the powerhouse of the cell")
+	photo := upload("photo.png", "image/png", "\x89PNG\r\n\x1a\n")
+
+	status, answer := askForm(t, app, token, "new", url.Values{"question": {"summarize"}, "files": {notes.ID.Hex()}})
+	if status != fiber.StatusOK || !strings.Contains(answer, "mitochondria is the powerhouse of the cell") {
+		t.Fatalf("got %d %q, want the attached file to reach the model", status, answer)
+	}
+
+	chat, err := chats.Newest(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := chat.Path()[0].Parts[0]
+	if part.Type != PartFile || part.FileID != notes.ID || part.Name != "notes.txt" {
+		t.Errorf("stored the attachment as %+v, want a reference to %s", part, notes.ID.Hex())
+	}
+
+	// Follow-up questions replay the question with the file's contents.
+	ask(t, app, token, chat.ID.Hex(), "and the nucleus?")
+	sent := lastSent(t, "fake")
+	want := []MessagePart{textPart(delimitedText("notes.txt", "mitochondria is the powerhouse of the cell")), textPart("summarize")}
+	if len(sent.history) != 2 || !reflect.DeepEqual(sent.history[0].Parts, want) || sent.history[1].Role != "model" || sent.message.Text() != "and the nucleus?" {
+		t.Errorf("follow-up sent %+v after %+v, want the attachment and question replayed", sent.message, sent.history)
+	}
+
+	// The fake model isn't multimodal, so it can't be sent the image.
+	status, answer = askForm(t, app, token, chat.ID.Hex(), url.Values{"question": {"and this?"}, "files": {photo.ID.Hex()}})
+	if status != fiber.StatusBadRequest || !strings.Contains(answer, "photo.png") {
+		t.Errorf("got %d %q, want the image to be refused", status, answer)
+	}
+
+	other := &File{User: primitive.NewObjectID(), Name: "secret.txt", Path: notes.Path, MIMEType: "text/plain"}
+	if err := uploads.Create(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = askForm(t, app, token, chat.ID.Hex(), url.Values{"question": {"read it"}, "files": {other.ID.Hex()}})
+	if status != fiber.StatusBadRequest {
+		t.Errorf("attaching another user's file got status %d, want %d", status, fiber.StatusBadRequest)
+	}
+}
+
+func TestAskEvents(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := askForm(t, app, token, "new", url.Values{"question": {"hello"}})
+	events := parseEvents(t, body)
+	if status != fiber.StatusOK || len(events) < 3 {
+		t.Fatalf("got %d:\n%s", status, body)
+	}
+
+	chat, err := chats.Newest(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := events[0]
+	if meta.Name != EventMeta || meta.Data["chatId"] != chat.ID.Hex() || meta.Data["title"] != chat.Title || meta.Data["messageId"] != chat.Leaf.Hex() || meta.Data["questionId"] != chat.Path()[0].ID.Hex() {
+		t.Errorf("first event is %+v, want the meta of chat %s", meta, chat.ID.Hex())
+	}
+	for _, event := range events[1 : len(events)-1] {
+		if event.Name != EventDelta {
+			t.Errorf("got %+v between meta and done, want only deltas", event)
+		}
+	}
+	if done := events[len(events)-1]; done.Name != EventDone || done.Data["finishReason"] != FinishStop {
+		t.Errorf("last event is %+v, want done", done)
+	}
+
+	// Follow-ups carry no title.
+	_, body = askForm(t, app, token, chat.ID.Hex(), url.Values{"question": {"fail"}})
+	events = parseEvents(t, body)
+	if _, ok := events[0].Data["title"]; ok || events[0].Data["chatId"] != chat.ID.Hex() {
+		t.Errorf("follow-up meta is %+v", events[0])
+	}
+	failed := events[len(events)-2]
+	if failed.Name != EventError || failed.Data["code"] != ErrorCodeModel || events[len(events)-1].Name != EventDone {
+		t.Errorf("failed answer ends with %+v, want a %s error and done", events[len(events)-2:], ErrorCodeModel)
+	}
+	// What was generated before the failure is kept.
+	chat, err = chats.Get(ctx, chat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := chat.Path(); len(path) != 4 || path[3].FinishReason != FinishOther || !strings.HasSuffix(path[3].Text(), "\nfail") {
+		t.Errorf("saved messages %+v, want the failed answer as far as it got", path)
+	}
+}
+
+func TestNewChatTitle(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake summarizer answers with the instruction it was given.
+	title, err := generateTitle(ctx, "what is a mitochondrion?")
+	if err != nil || title != titleInstruction {
+		t.Errorf("got title %q, %v, want the summarizer's answer to the title instruction", title, err)
+	}
+
+	ask(t, app, token, "new", "what is a mitochondrion?")
+	chat, err := chats.Newest(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.Title != titleInstruction {
+		t.Errorf("new chat is titled %q, want the summarizer's title", chat.Title)
+	}
+
+	// Without a title, the question isn't asked and no chat is created.
+	status, body := askForm(t, app, token, "new", url.Values{"question": {"fail"}})
+	if status != fiber.StatusInternalServerError {
+		t.Errorf("got %d %q, want the failed title to fail the question", status, body)
+	}
+	chatList, err := chats.ListByUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chatList) != 1 {
+		t.Errorf("got %d chats, want only the titled one", len(chatList))
+	}
+}
+
+func TestEditAndRegenerate(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notes := &File{User: user.ID, Name: "notes.txt", Path: filepath.Join(t.TempDir(), "notes.txt"), MIMEType: "text/plain"}
+	if err := os.WriteFile(notes.Path, []byte("ribosomes make proteins"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploads.Create(ctx, notes); err != nil {
+		t.Fatal(err)
+	}
+
+	askForm(t, app, token, "new", url.Values{"question": {"summarise"}, "files": {notes.ID.Hex()}})
+	chat, err := chats.Newest(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ask(t, app, token, chat.ID.Hex(), "and then?")
+
+	answer := func(body string) string {
+		var answer string
+		for _, event := range parseEvents(t, body) {
+			if event.Name == EventDelta {
+				answer += event.Data["text"].(string)
+			}
+		}
+		return answer
+	}
+	chat, err = chats.Get(ctx, chat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := chat.Path()
+	base := "/api/chats/" + chat.ID.Hex() + "/messages/"
+
+	// Editing the first question answers it in a new branch, keeping its
+	// attachment.
+	status, body := postForm(t, app, token, base+original[0].ID.Hex()+"/edit", url.Values{"question": {"summarize"}})
+	if status != fiber.StatusOK || !strings.Contains(answer(body), "ribosomes make proteins\n--- End of file notes.txt ---\nsummarize") {
+		t.Fatalf("editing got %d:\n%s", status, body)
+	}
+	chat, err = chats.Get(ctx, chat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	turns := chat.Turns()
+	if len(turns) != 2 || turns[0].Text() != "summarize" || turns[0].Parts[0].FileID != notes.ID {
+		t.Fatalf("edited branch %+v, want the edited question and its answer", turns)
+	}
+	if len(chat.Messages) != 6 || turns[0].Index != 1 || turns[0].Previous() != original[0].ID || !turns[0].Next().IsZero() {
+		t.Errorf("edited question is %d of %v, want it after the original", turns[0].Index, turns[0].Siblings)
+	}
+
+	first := turns[1].ID
+	status, body = postForm(t, app, token, base+first.Hex()+"/regenerate", nil)
+	if status != fiber.StatusOK || !strings.HasSuffix(answer(body), "\nsummarize") {
+		t.Fatalf("regenerating got %d:\n%s", status, body)
+	}
+	chat, err = chats.Get(ctx, chat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	turns = chat.Turns()
+	if len(turns) != 2 || turns[0].Text() != "summarize" || turns[1].ID == first || len(turns[1].Siblings) != 2 {
+		t.Errorf("regenerated branch %+v, want a second answer to the same question", turns)
+	}
+
+	// Selecting the original question goes back to where its branch was
+	// left.
+	status, body = postForm(t, app, token, base+original[0].ID.Hex()+"/select", nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("selecting got %d %q", status, body)
+	}
+	chat, err = chats.Get(ctx, chat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.Leaf != original[3].ID || !reflect.DeepEqual(chat.Path(), original) {
+		t.Errorf("selected branch %+v, want the original %+v", chat.Path(), original)
+	}
+
+	unknown := primitive.NewObjectID().Hex()
+	for path, want := range map[string]int{
+		base + original[1].ID.Hex() + "/edit":                                fiber.StatusBadRequest, // an answer
+		base + original[0].ID.Hex() + "/regenerate":                          fiber.StatusBadRequest, // a question
+		base + unknown + "/regenerate":                                       fiber.StatusBadRequest,
+		base + "x/regenerate":                                                fiber.StatusBadRequest,
+		base + unknown + "/select":                                           fiber.StatusNotFound,
+		"/api/chats/" + unknown + "/messages/" + first.Hex() + "/regenerate": fiber.StatusNotFound,
+	} {
+		if status, body := postForm(t, app, token, path, url.Values{"question": {"hi"}}); status != want {
+			t.Errorf("POST %s got %d %q, want %d", path, status, body, want)
+		}
+	}
+
+	// Nothing can be rewound while an answer is being generated.
+	asked := make(chan struct{})
+	go func() {
+		askForm(t, app, token, chat.ID.Hex(), url.Values{"question": {"wait"}})
+		close(asked)
+	}()
+	g := waitForGeneration(t, user.ID, 2)
+	for _, path := range []string{base + first.Hex() + "/regenerate", base + first.Hex() + "/select"} {
+		if status, body := postForm(t, app, token, path, nil); status != fiber.StatusConflict {
+			t.Errorf("POST %s during a generation got %d %q, want %d", path, status, body, fiber.StatusConflict)
+		}
+	}
+	generations.stop(g.id, user.ID)
+	<-asked
+}
+
+// waitForGeneration waits for the generation in a user's newest chat to
+// have emitted n events. The reply's ID only reaches the client in the
+// response, which app.Test returns whole.
+func waitForGeneration(t *testing.T, userID primitive.ObjectID, n int) *generation {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		chat, err := chats.Newest(context.Background(), userID)
+		if err != nil {
+			continue
+		}
+		if g, ok := generations.forChat(chat.ID); ok {
+			if events, _, _ := g.after(0); len(events) >= n {
+				return g
+			}
+		}
+	}
+
+	t.Fatal("the generation never started")
+	return nil
+}
+
+// waitForFollowers waits for n clients to follow a generation.
+func waitForFollowers(t *testing.T, g *generation, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		g.mu.Lock()
+		followers := g.followers
+		g.mu.Unlock()
+		if followers >= n {
+			return
+		}
+	}
+
+	t.Fatalf("the generation never had %d followers", n)
+}
+
+// followEvents gets a generation's events after the one with ID
+// lastEventID, if it's set.
+func followEvents(t *testing.T, app *fiber.App, token, id, lastEventID string) (int, string) {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/api/ask/"+id+"/events", nil)
+	req.Header.Set("Cookie", "token="+token)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Error(err)
+		return 0, ""
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestForkChat(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ask(t, app, token, "new", "hello")
+	chat, err := chats.Newest(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ask(t, app, token, chat.ID.Hex(), "and then?")
+	chat, err = chats.Get(ctx, chat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := chat.Path()
+	base := "/api/chats/" + chat.ID.Hex() + "/messages/"
+
+	// Forking from the first answer copies the first question and answer.
+	status, body := postForm(t, app, token, base+original[1].ID.Hex()+"/fork", url.Values{"title": {"Greetings"}})
+	if status != fiber.StatusOK {
+		t.Fatalf("forking got %d %q", status, body)
+	}
+	var forked struct{ ID, Title, Model string }
+	if err := json.Unmarshal([]byte(body), &forked); err != nil {
+		t.Fatal(err)
+	}
+	id, err := ObjectIDFromHex(forked.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork, err := chats.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fork.Path()
+	if fork.User != user.ID || fork.Title != "Greetings" || fork.Model != chat.Model || len(fork.Messages) != 2 || len(path) != 2 {
+		t.Fatalf("forked chat %+v, want the first two messages as Greetings", fork)
+	}
+	for i, message := range path {
+		if message.ID == original[i].ID || message.Text() != original[i].Text() {
+			t.Errorf("forked message %+v, want a copy of %+v", message, original[i])
+		}
+	}
+
+	// The fork goes on by itself.
+	ask(t, app, token, fork.ID.Hex(), "something else")
+	if chat, err = chats.Get(ctx, chat.ID); err != nil || len(chat.Messages) != 4 {
+		t.Errorf("original chat has %d messages after the fork went on, %v", len(chat.Messages), err)
+	}
+
+	// Without a title, the fork gets one of its own, or the original's if
+	// the summarizer fails.
+	status, body = postForm(t, app, token, base+original[0].ID.Hex()+"/fork", nil)
+	if err := json.Unmarshal([]byte(body), &forked); status != fiber.StatusOK || err != nil || forked.Title != titleInstruction {
+		t.Errorf("forking without a title got %d %q, want a generated title", status, body)
+	}
+	if err := chats.Rename(ctx, chat.ID, "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	ask(t, app, token, chat.ID.Hex(), "what if they fail")
+	if chat, err = chats.Get(ctx, chat.ID); err != nil {
+		t.Fatal(err)
+	}
+	status, body = postForm(t, app, token, base+chat.Leaf.Hex()+"/fork", nil)
+	if status != fiber.StatusOK || !strings.Contains(body, `"title":"Hello (fork)"`) {
+		t.Errorf("forking when the summarizer fails got %d %q", status, body)
+	}
+
+	unknown := primitive.NewObjectID().Hex()
+	for path, want := range map[string]int{
+		base + unknown + "/fork": fiber.StatusNotFound,
+		"/api/chats/" + unknown + "/messages/" + original[0].ID.Hex() + "/fork": fiber.StatusNotFound,
+	} {
+		if status, body := postForm(t, app, token, path, nil); status != want {
+			t.Errorf("POST %s got %d %q, want %d", path, status, body, want)
+		}
+	}
+	if status, body := postForm(t, app, token, base+original[0].ID.Hex()+"/fork", url.Values{"model": {"nope"}}); status != fiber.StatusBadRequest {
+		t.Errorf("forking to an unknown model got %d %q", status, body)
+	}
+}
+
+func TestSwitchModel(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	config := filepath.Join(t.TempDir(), "models.json")
+	err := os.WriteFile(config, []byte(`{
+		"default": "fake",
+		"summarizer": "fake",
+		"models": [
+			{"id": "fake", "name": "Fake", "backend": "fake", "enabled": true},
+			{"id": "fake-vision", "name": "Fake Vision", "backend": "fake", "multimodal": true, "enabled": true}
+		]
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err = loadModelRegistry(config, map[string]Provider{"fake": &fakeProvider{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	photo := &File{User: user.ID, Name: "photo.png", Path: filepath.Join(t.TempDir(), "photo.png"), MIMEType: "image/png"}
+	if err := os.WriteFile(photo.Path, []byte("\x89PNG\r\n\x1a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploads.Create(ctx, photo); err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := askForm(t, app, token, "new", url.Values{"question": {"what is this?"}, "model": {"fake-vision"}, "files": {photo.ID.Hex()}})
+	if status != fiber.StatusOK {
+		t.Fatalf("asking the vision model got %d %q", status, body)
+	}
+	sent := lastSent(t, "fake-vision")
+	if len(sent.history) != 0 || len(sent.message.Parts) != 2 || sent.message.Parts[0].Type != PartInlineData || string(sent.message.Parts[0].Data) != "\x89PNG\r\n\x1a\n" {
+		t.Errorf("the vision model was sent %+v, want the photo", sent.message)
+	}
+	chat, err := chats.Newest(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Before switching, the page can warn that the photo won't be seen.
+	status, result := fileRequest(t, app, token, "GET", "/api/chats/"+chat.ID.Hex()+"/warning?model=fake", "")
+	if warning, _ := result["warning"].(string); status != fiber.StatusOK || !strings.Contains(warning, "Fake can't read photo.png") {
+		t.Errorf("warning for the text model got %d %v", status, result)
+	}
+	status, result = fileRequest(t, app, token, "GET", "/api/chats/"+chat.ID.Hex()+"/warning?model=fake-vision", "")
+	if status != fiber.StatusOK || result["warning"] != "" {
+		t.Errorf("warning for the vision model got %d %v", status, result)
+	}
+	if status, _ := fileRequest(t, app, token, "GET", "/api/chats/"+chat.ID.Hex()+"/warning?model=nope", ""); status != fiber.StatusBadRequest {
+		t.Errorf("warning for an unknown model got %d", status)
+	}
+
+	// The text model answers the next question, sent without the photo.
+	req := httptest.NewRequest("POST", "/api/ask?chat="+chat.ID.Hex(), strings.NewReader(url.Values{"question": {"and now?"}, "model": {"fake"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", "token="+token)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusOK || !strings.Contains(resp.Header.Get("X-Context-Warning"), "photo.png") {
+		t.Errorf("switching got %d with warning %q", resp.StatusCode, resp.Header.Get("X-Context-Warning"))
+	}
+
+	chat, err = chats.Get(ctx, chat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := chat.Path()
+	if len(path) != 4 || path[1].Model != "fake-vision" || path[3].Model != "fake" || chat.Model != "fake" {
+		t.Errorf("got replies by %q and %q in a %q chat, want the vision model then the text one", path[1].Model, path[3].Model, chat.Model)
+	}
+
+	// It was sent the earlier turns, with a note in place of the photo.
+	sent = lastSent(t, "fake")
+	want := []MessagePart{textPart("[photo.png (image/png) was attached here, but Fake can't read it.]"), textPart("what is this?")}
+	if len(sent.history) != 2 || !reflect.DeepEqual(sent.history[0].Parts, want) || sent.history[1].Text() != path[1].Text() || sent.message.Text() != "and now?" {
+		t.Errorf("the text model was sent %+v after %+v, want the vision model's turns without the photo", sent.message, sent.history)
+	}
+
+	// Questions without a model go to the one last picked.
+	ask(t, app, token, chat.ID.Hex(), "again")
+	if chat, err = chats.Get(ctx, chat.ID); err != nil || chat.Path()[5].Model != "fake" {
+		t.Errorf("unspecified model answered with %+v, %v", chat.Path()[5], err)
+	}
+
+	// Switching back sends the photo again, and the text model's turns.
+	if status, body := askForm(t, app, token, chat.ID.Hex(), url.Values{"question": {"look again"}, "model": {"fake-vision"}}); status != fiber.StatusOK {
+		t.Fatalf("switching back got %d %q", status, body)
+	}
+	sent = lastSent(t, "fake-vision")
+	if len(sent.history) != 6 || sent.history[0].Parts[0].Type != PartInlineData || sent.history[3].Text() != path[3].Text() || sent.message.Text() != "look again" {
+		t.Errorf("the vision model was sent %+v after %+v, want the whole branch with the photo", sent.message, sent.history)
+	}
+}
+
+func TestResumeGeneration(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asked := make(chan struct{})
+	go func() {
+		askForm(t, app, token, "new", url.Values{"question": {"wait"}})
+		close(asked)
+	}()
+
+	// The meta event and three deltas.
+	g := waitForGeneration(t, user.ID, 4)
+
+	resumed := make(chan string)
+	go func() {
+		_, body := followEvents(t, app, token, g.id.Hex(), "2")
+		resumed <- body
+	}()
+
+	// The answer ends once the resumed stream follows it alongside the
+	// original one.
+	waitForFollowers(t, g, 2)
+	fakeRelease <- struct{}{}
+	<-asked
+
+	events := parseEvents(t, <-resumed)
+	if len(events) < 3 || events[0].ID != "3" || events[0].Name != EventDelta {
+		t.Fatalf("resumed with %+v, want the events after the second", events)
+	}
+	if last := events[len(events)-1]; last.Name != EventDone || last.Data["finishReason"] != FinishStop {
+		t.Errorf("resumed stream ends with %+v, want done", last)
+	}
+
+	// Finished generations can still be replayed for a while.
+	if _, body := followEvents(t, app, token, g.id.Hex(), ""); !strings.HasPrefix(body, "id: 1\nevent: "+EventMeta) || !strings.Contains(body, "event: "+EventDone) {
+		t.Errorf("replaying a finished generation got:\n%s", body)
+	}
+	if status, _ := followEvents(t, app, token, primitive.NewObjectID().Hex(), ""); status != fiber.StatusNotFound {
+		t.Errorf("following an unknown generation got status %d, want %d", status, fiber.StatusNotFound)
+	}
+}
+
+func TestStopGeneration(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(saved time.Duration) { sseHeartbeat = saved }(sseHeartbeat)
+	sseHeartbeat = time.Millisecond
+
+	answered := make(chan string)
+	go func() {
+		_, body := askForm(t, app, token, "new", url.Values{"question": {"wait"}})
+		answered <- body
+	}()
+
+	id := waitForGeneration(t, user.ID, 4).id
+
+	// Let a few heartbeats through while the model is quiet.
+	time.Sleep(20 * time.Millisecond)
+
+	if status, _ := fileRequest(t, app, token, "POST", "/api/ask/"+primitive.NewObjectID().Hex()+"/cancel", ""); status != fiber.StatusNotFound {
+		t.Errorf("cancelling a generation that isn't running got status %d, want %d", status, fiber.StatusNotFound)
+	}
+	if status, result := fileRequest(t, app, token, "POST", "/api/ask/"+id.Hex()+"/cancel", ""); status != fiber.StatusOK {
+		t.Fatalf("cancelling got %d %v", status, result)
+	}
+
+	body := <-answered
+	if !strings.Contains(body, "\n: heartbeat\n\n") {
+		t.Errorf("got no heartbeats while the model was quiet:\n%s", body)
+	}
+	var answer string
+	events := parseEvents(t, body)
+	for _, event := range events {
+		if event.Name == EventDelta {
+			answer += event.Data["text"].(string)
+		}
+	}
+	if !strings.HasSuffix(answer, "\nwait") {
+		t.Errorf("got answer %q, want the part generated before stopping", answer)
+	}
+	if last := events[len(events)-1]; last.Name != EventDone || last.Data["finishReason"] != FinishStopped {
+		t.Errorf("last event is %+v, want done with finish reason %q", last, FinishStopped)
+	}
+
+	chat, err := chats.Newest(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := chat.message(chat.Leaf)
+	if reply.ID != id || reply.FinishReason != FinishStopped || reply.Text() != answer {
+		t.Errorf("saved reply %+v, want the partial answer marked %q", reply, FinishStopped)
+	}
+	if status, _ := fileRequest(t, app, token, "POST", "/api/ask/"+id.Hex()+"/cancel", ""); status != fiber.StatusNotFound {
+		t.Errorf("cancelling a stopped generation got status %d, want %d", status, fiber.StatusNotFound)
+	}
+}
+
+func TestOneAnswerPerChat(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ask(t, app, token, "new", "hello")
+	chat, err := chats.Newest(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Questions sent at once from several tabs: one is answered, the others
+	// are refused before they touch the chat.
+	const n = 10
+	started := make(chan *generation, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			g, _, err := startAsk(user, askRequest{Chat: chat.ID.Hex(), Question: "wait"})
+			var askErr *askError
+			switch {
+			case err == nil:
+				started <- g
+			case !errors.As(err, &askErr) || askErr.Status != fiber.StatusConflict:
+				t.Errorf("got %v, want the chat busy", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(started)
+
+	var running []*generation
+	for g := range started {
+		running = append(running, g)
+	}
+	if len(running) != 1 {
+		t.Fatalf("started %d answers in the chat, want 1", len(running))
+	}
+	fakeRelease <- struct{}{}
+	for {
+		_, done, changed := running[0].after(0)
+		if done {
+			break
+		}
+		<-changed
+	}
+
+	if chat, err = chats.Get(ctx, chat.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(chat.Messages) != 4 || len(chat.Path()) != 4 {
+		t.Errorf("chat has messages %+v, want one more question and answer", chat.Messages)
+	}
+}
+
+// heldChatStore holds up the first time a chat is read, after reading it,
+// until resumed.
+type heldChatStore struct {
+	ChatStore
+	once   sync.Once
+	read   chan struct{}
+	resume chan struct{}
+}
+
+func (s *heldChatStore) Get(ctx context.Context, id primitive.ObjectID) (*Chat, error) {
+	chat, err := s.ChatStore.Get(ctx, id)
+	s.once.Do(func() {
+		close(s.read)
+		<-s.resume
+	})
+	return chat, err
+}
+
+func TestAnswerFinishingWhileAsking(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ask(t, app, token, "new", "hello")
+	chat, err := chats.Newest(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _, err := startAsk(user, askRequest{Chat: chat.ID.Hex(), Question: "wait"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next question reads the chat while the first answer is still
+	// being generated, which then finishes before the question is saved.
+	held := &heldChatStore{ChatStore: chats, read: make(chan struct{}), resume: make(chan struct{})}
+	chats = held
+	type started struct {
+		g   *generation
+		err error
+	}
+	asked := make(chan started)
+	go func() {
+		g, _, err := startAsk(user, askRequest{Chat: chat.ID.Hex(), Question: "next"})
+		asked <- started{g, err}
+	}()
+	<-held.read
+	fakeRelease <- struct{}{}
+	for {
+		_, done, changed := first.after(0)
+		if done {
+			break
+		}
+		<-changed
+	}
+	close(held.resume)
+
+	second := <-asked
+	if second.err != nil {
+		t.Fatal(second.err)
+	}
+	for {
+		_, done, changed := second.g.after(0)
+		if done {
+			break
+		}
+		<-changed
+	}
+
+	if chat, err = chats.Get(ctx, chat.ID); err != nil {
+		t.Fatal(err)
+	}
+	path := chat.Path()
+	if len(path) != 6 || path[3].ID != first.id || path[4].Text() != "next" || path[5].ID != second.g.id {
+		t.Errorf("chat has the branch %+v, want both questions with their answers", path)
+	}
+}
+
+func TestAbandonedGeneration(t *testing.T) {
+	newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(saved time.Duration) { generationAbandonment = saved }(generationAbandonment)
+	generationAbandonment = time.Millisecond
+
+	// Nobody follows a generation started without a client, as when the
+	// tab that asked is closed right away.
+	g, _, err := startAsk(user, askRequest{Chat: "new", Question: "wait"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, done, changed := g.after(0)
+		if done {
+			break
+		}
+		<-changed
+	}
+
+	chat, err := chats.Get(ctx, g.chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := chat.message(chat.Leaf)
+	if reply.ID != g.id || reply.FinishReason != FinishStopped || !strings.HasSuffix(reply.Text(), "\nwait") {
+		t.Errorf("saved reply %+v, want the partial answer marked %q", reply, FinishStopped)
+	}
+}
+
+func TestDownloadChecksOwnership(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, size, err := blobs.Put(ctx, strings.NewReader("lab report"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine := &File{User: user.ID, Name: "report.txt", MIMEType: "text/plain", Size: size, Blob: key}
+	theirs := &File{User: primitive.NewObjectID(), Name: "theirs.txt", MIMEType: "text/plain", Size: size, Blob: key}
+	for _, file := range []*File{mine, theirs} {
+		if err := uploads.Create(ctx, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	download := func(id string) (*http.Response, string) {
+		req := httptest.NewRequest("GET", "/api/files/"+id+"/download", nil)
+		req.Header.Set("Cookie", "token="+token)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	resp, body := download(mine.ID.Hex())
+	if resp.StatusCode != fiber.StatusOK || body != "lab report" {
+		t.Fatalf("downloading own file got %d %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename=report.txt` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	for _, id := range []string{theirs.ID.Hex(), primitive.NewObjectID().Hex(), "not-an-id"} {
+		if resp, _ := download(id); resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("downloading %s got status %d, want %d", id, resp.StatusCode, fiber.StatusNotFound)
+		}
+	}
+}
+
+// uploadFile posts a file to /api/upload and returns the status and the
+// decoded JSON response.
+func uploadFile(t *testing.T, app *fiber.App, token, name, contentType, content string) (int, map[string]any) {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, name))
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(part, content)
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/api/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Cookie", "token="+token)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, result
+}
+
+func TestUploadValidation(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	defer func(saved uploadLimits) { limits = saved }(limits)
+	limits = uploadLimits{MaxFileSize: 100, UserQuota: 150, GroupQuota: 200}
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The memory store hands out copies, so put the user in a group by
+	// storing them again.
+	user.Group = "biology"
+	classmate := &User{Email: "classmate@example.com", StudentID: "2", Group: "biology"}
+	users = newMemoryUserStore()
+	for _, u := range []*User{user, classmate} {
+		if err := users.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The fake model only reads text, and a PNG doesn't become text by
+	// claiming to be.
+	status, result := uploadFile(t, app, token, "notes.txt", "text/plain", "\x89PNG\r\n\x1a\n")
+	if status != fiber.StatusUnsupportedMediaType || !strings.Contains(result["error"].(string), "image/png") {
+		t.Errorf("uploading a disguised image got %d %v", status, result)
+	}
+
+	status, result = uploadFile(t, app, token, "data.csv", "text/csv", "a,b\n1,2\n")
+	if status != fiber.StatusOK || result["mimeType"] != "text/csv" {
+		t.Errorf("uploading a CSV got %d %v", status, result)
+	}
+
+	status, result = uploadFile(t, app, token, "big.txt", "text/plain", strings.Repeat("a", 101))
+	if status != fiber.StatusRequestEntityTooLarge || !strings.Contains(result["error"].(string), "limit") {
+		t.Errorf("uploading a file over the size limit got %d %v", status, result)
+	}
+
+	status, result = uploadFile(t, app, token, "one.txt", "text/plain", strings.Repeat("b", 100))
+	if status != fiber.StatusOK {
+		t.Fatalf("uploading within the quota got %d %v", status, result)
+	}
+	status, result = uploadFile(t, app, token, "two.txt", "text/plain", strings.Repeat("c", 100))
+	if status != fiber.StatusRequestEntityTooLarge || !strings.Contains(result["error"].(string), "your storage quota") {
+		t.Errorf("uploading past the user quota got %d %v", status, result)
+	}
+
+	// Uploading the same contents again takes no more space.
+	status, result = uploadFile(t, app, token, "again.txt", "text/plain", strings.Repeat("b", 100))
+	if status != fiber.StatusOK {
+		t.Errorf("uploading a duplicate at the quota got %d %v", status, result)
+	}
+
+	if err := uploads.Create(ctx, &File{User: classmate.ID, Group: "biology", Size: 95}); err != nil {
+		t.Fatal(err)
+	}
+	status, result = uploadFile(t, app, token, "three.txt", "text/plain", "d")
+	if status != fiber.StatusRequestEntityTooLarge || !strings.Contains(result["error"].(string), "group biology") {
+		t.Errorf("uploading past the group quota got %d %v", status, result)
+	}
+
+	quota, err := quotaStatus(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Used != 108 || quota.GroupUsed != 203 {
+		t.Errorf("quota = %+v, want 108 bytes used by the user and 203 by the group", quota)
+	}
+}
+
+func TestConcurrentUploadsStayWithinQuota(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	defer func(saved uploadLimits) { limits = saved }(limits)
+	limits = uploadLimits{MaxFileSize: 100, UserQuota: 150}
+
+	const n = 20
+	var wg sync.WaitGroup
+	statuses := make(chan int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(content string) {
+			defer wg.Done()
+
+			status, _ := uploadFile(t, app, token, "notes.txt", "text/plain", content)
+			statuses <- status
+		}(fmt.Sprintf("%060d", i))
+	}
+	wg.Wait()
+	close(statuses)
+
+	uploaded := 0
+	for status := range statuses {
+		if status == fiber.StatusOK {
+			uploaded++
+		} else if status != fiber.StatusRequestEntityTooLarge {
+			t.Errorf("got status %d, want uploads that don't fit refused", status)
+		}
+	}
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := uploads.UserUsage(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded != 2 || used != 120 {
+		t.Errorf("uploaded %d files using %d bytes, want the 2 that fit in the quota", uploaded, used)
+	}
+}
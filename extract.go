@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// maxExtractedText caps the text kept from one document, well under
+// MongoDB's 16 MB document limit.
+const maxExtractedText = 8 << 20
+
+// maxDocumentPart caps how much of one file inside a DOCX or ODT archive is
+// read, so that a zip bomb can't exhaust memory.
+const maxDocumentPart = 64 << 20
+
+// textExtractors turn documents that models can't read natively into text.
+// Text files need no extracting and are sent as they are.
+var textExtractors = map[string]func(data []byte) (string, error){
+	"application/pdf": extractPDFText,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": extractDOCXText,
+	"application/vnd.oasis.opendocument.text":                                 extractODTText,
+}
+
+// isDocumentMIMEType reports whether text can be extracted from files of a
+// type.
+func isDocumentMIMEType(mimeType string) bool {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	return textExtractors[mimeType] != nil
+}
+
+// errNoText is returned for documents without any text, such as scanned
+// PDFs.
+var errNoText = errors.New("no text found")
+
+// extractText returns the text of a document, cut off at maxExtractedText.
+func extractText(mimeType string, data []byte) (string, error) {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	extract, ok := textExtractors[mimeType]
+	if !ok {
+		return "", fmt.Errorf("can't extract text from %s", mimeType)
+	}
+
+	text, err := extract(data)
+	if err != nil {
+		return "", err
+	}
+
+	text = strings.TrimSpace(strings.ToValidUTF8(text, "�"))
+	if text == "" {
+		return "", errNoText
+	}
+	if len(text) > maxExtractedText {
+		cut := maxExtractedText
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut] + "\n[...]"
+	}
+
+	return text, nil
+}
+
+// delimitedText wraps the text of an attached file in the delimiters that
+// tell the model where the file starts and ends.
+func delimitedText(name, text string) string {
+	return "--- Start of file " + name + " ---\n" + text + "\n--- End of file " + name + " ---\n"
+}
+
+func extractPDFText(data []byte) (text string, err error) {
+	// The PDF reader panics on some malformed files.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("reading PDF: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fonts := make(map[string]*pdf.Font)
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		for _, name := range page.Fonts() {
+			if _, ok := fonts[name]; !ok {
+				font := page.Font(name)
+				fonts[name] = &font
+			}
+		}
+
+		pageText, err := page.GetPlainText(fonts)
+		if err != nil {
+			return "", fmt.Errorf("page %d: %w", i, err)
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(pageText)
+
+		if b.Len() > maxExtractedText {
+			break
+		}
+	}
+
+	return b.String(), nil
+}
+
+// readZipFile reads one file out of a zip archive.
+func readZipFile(data []byte, name string) ([]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := archive.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer f.Close()
+
+	return io.ReadAll(io.LimitReader(f, maxDocumentPart))
+}
+
+// extractDOCXText reads the paragraphs of a Word document's body.
+func extractDOCXText(data []byte) (string, error) {
+	document, err := readZipFile(data, "word/document.xml")
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	inRun, inText := false, false
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			// Paragraph properties have tab elements too, for tab stops.
+			switch t.Name.Local {
+			case "r":
+				inRun = true
+			case "t":
+				inText = true
+			case "tab":
+				if inRun {
+					b.WriteByte('\t')
+				}
+			case "br", "cr":
+				if inRun {
+					b.WriteByte('\n')
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "r":
+				inRun = false
+			case "t":
+				inText = false
+			case "p":
+				b.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText {
+				b.Write(t)
+			}
+		}
+	}
+
+	return b.String(), nil
+}
+
+// extractODTText reads the paragraphs and headings of an OpenDocument text
+// file.
+func extractODTText(data []byte) (string, error) {
+	content, err := readZipFile(data, "content.xml")
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	depth := 0 // of the text:p and text:h elements around the current token
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p", "h":
+				depth++
+			case "tab":
+				b.WriteByte('\t')
+			case "line-break":
+				b.WriteByte('\n')
+			case "s":
+				// text:s stands for text:c spaces, one by default.
+				n := 1
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "c" {
+						if c, err := strconv.Atoi(attr.Value); err == nil && c > 0 && c < 1000 {
+							n = c
+						}
+					}
+				}
+				b.WriteString(strings.Repeat(" ", n))
+			}
+		case xml.EndElement:
+			if t.Name.Local == "p" || t.Name.Local == "h" {
+				depth--
+				b.WriteByte('\n')
+			}
+		case xml.CharData:
+			if depth > 0 {
+				b.Write(t)
+			}
+		}
+	}
+
+	return b.String(), nil
+}
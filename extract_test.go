@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// zipFile builds a zip archive holding one file, the way DOCX and ODT files
+// are packaged.
+func zipFile(t *testing.T, name, content string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	w, err := archive.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// minimalPDF builds a one page PDF showing text in a standard font.
+func minimalPDF(text string) []byte {
+	stream := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(stream), stream),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestExtractText(t *testing.T) {
+	docx := zipFile(t, "word/document.xml", `<?xml version="1.0"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:pPr><w:tabs><w:tab w:val="left" w:pos="720"/></w:tabs></w:pPr><w:r><w:t>Photosynthesis</w:t></w:r></w:p>
+<w:p><w:r><w:t xml:space="preserve">Light </w:t></w:r><w:r><w:t>reactions</w:t><w:tab/><w:t>p. 4</w:t></w:r></w:p>
+</w:body></w:document>`)
+	odt := zipFile(t, "content.xml", `<?xml version="1.0"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:text>
+<text:h>Photosynthesis</text:h>
+<text:p>Light<text:s text:c="2"/><text:span>reactions</text:span><text:line-break/>p. 4</text:p>
+</office:text></office:body></office:document-content>`)
+
+	for _, test := range []struct {
+		mimeType string
+		data     []byte
+		want     string
+	}{
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", docx, "Photosynthesis\nLight reactions\tp. 4"},
+		{"application/vnd.oasis.opendocument.text", odt, "Photosynthesis\nLight  reactions\np. 4"},
+		{"application/pdf", minimalPDF("Photosynthesis"), "Photosynthesis"},
+	} {
+		got, err := extractText(test.mimeType, test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.mimeType, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.mimeType, got, test.want)
+		}
+	}
+
+	if _, err := extractText("application/pdf", []byte("%PDF-1.4\ngarbage")); err == nil {
+		t.Error("extracting a broken PDF succeeded")
+	}
+}
+
+func TestDocumentsAreSentAsTextToTextOnlyModels(t *testing.T) {
+	newTestApp(t)
+	ctx := context.Background()
+
+	key, size, err := blobs.Put(ctx, bytes.NewReader(minimalPDF("Chlorophyll absorbs light")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a File record, the text is extracted again from the blob.
+	part := MessagePart{Type: PartFile, Blob: key, MIMEType: "application/pdf", Name: "notes.pdf"}
+	messages := []Message{newMessage("user", part, textPart("summarize"))}
+
+	textOnly := ModelConfig{Name: "Text", ContextWindow: 1000}
+	expanded, err := expandAttachments(ctx, textOnly, messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := delimitedText("notes.pdf", "Chlorophyll absorbs light")
+	if got := expanded[0].Parts[0]; got.Type != PartText || got.Text != want {
+		t.Errorf("sent %+v, want the text of the PDF", got)
+	}
+
+	multimodal := ModelConfig{Name: "Multimodal", Multimodal: true}
+	expanded, err = expandAttachments(ctx, multimodal, messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := expanded[0].Parts[0]; got.Type != PartInlineData || int64(len(got.Data)) != size {
+		t.Errorf("sent %+v to a multimodal model, want the PDF itself", got)
+	}
+
+	// Images from earlier in the chat, sent to another model, are left out.
+	image := MessagePart{Type: PartFile, Blob: key, MIMEType: "image/png", Name: "chart.png"}
+	earlier := []Message{newMessage("user", image), newMessage("model", textPart("a chart")), newMessage("user", textPart("and?"))}
+	sent, err := expandAttachments(ctx, textOnly, earlier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sent[0].Parts[0]; got.Type != PartText || !strings.Contains(got.Text, "chart.png (image/png) was attached here, but Text can't read it") {
+		t.Errorf("sent %+v for an earlier image, want a note", got)
+	}
+	if _, err := expandAttachments(ctx, textOnly, earlier[:1]); !errors.Is(err, ErrUnsupportedAttachment) {
+		t.Errorf("sending an image to a text model got %v, want %v", err, ErrUnsupportedAttachment)
+	}
+	if warning := attachmentWarning(textOnly, earlier); !strings.Contains(warning, "Text can't read chart.png") {
+		t.Errorf("got warning %q, want one about the image", warning)
+	}
+
+	textOnly.ContextWindow = 5
+	if warning := contextWarning(textOnly, expanded); warning != "" {
+		t.Errorf("got a warning for inline data: %q", warning)
+	}
+	expanded, _ = expandAttachments(ctx, textOnly, messages)
+	if warning := contextWarning(textOnly, expanded); !strings.Contains(warning, "more than the 5") {
+		t.Errorf("got warning %q, want one about the context window", warning)
+	}
+}
+
+func TestUploadExtractsText(t *testing.T) {
+	app, token := newTestApp(t)
+
+	// The fake model is text only, so a PDF is only accepted for its text.
+	status, result := uploadFile(t, app, token, "notes.pdf", "application/pdf", string(minimalPDF("Mitochondria")))
+	if status != fiber.StatusOK {
+		t.Fatalf("uploading a PDF got %d %v", status, result)
+	}
+	id, _ := ObjectIDFromHex(result["id"].(string))
+	file, err := uploads.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Text != "Mitochondria" {
+		t.Errorf("stored text %q, want the PDF's text", file.Text)
+	}
+
+	status, result = uploadFile(t, app, token, "scan.pdf", "application/pdf", string(minimalPDF("")))
+	if status != fiber.StatusUnsupportedMediaType || !strings.Contains(result["error"].(string), "no text found") {
+		t.Errorf("uploading a PDF without text got %d %v", status, result)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FileInfo is an upload as listed by the file manager.
+type FileInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	MIMEType   string     `json:"mimeType"`
+	Size       int64      `json:"size"`
+	UploadedAt time.Time  `json:"uploadedAt"`
+	Thumbnail  bool       `json:"thumbnail"`
+	Chats      []ChatLink `json:"chats"`
+}
+
+// ChatLink is a chat that attaches a file.
+type ChatLink struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// listFiles returns a user's uploads, newest first, with the chats that
+// attach each one.
+func listFiles(ctx context.Context, userID primitive.ObjectID) ([]FileInfo, error) {
+	files, err := uploads.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	fileChats, err := chats.FileChats(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]FileInfo, 0, len(files))
+	for _, file := range files {
+		info := FileInfo{
+			ID:         file.ID.Hex(),
+			Name:       file.Name,
+			MIMEType:   file.MIMEType,
+			Size:       file.Size,
+			UploadedAt: file.ID.Timestamp(),
+			Thumbnail:  file.Thumbnail != "",
+			Chats:      []ChatLink{},
+		}
+		for _, chat := range fileChats[file.ID] {
+			info.Chats = append(info.Chats, ChatLink{ID: chat.ID.Hex(), Title: chat.Title})
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// ownedFile looks up one of user's files by its hex ID. Other users' files
+// are reported as not found, so that file IDs can't be probed.
+func ownedFile(ctx context.Context, user *User, id string) (*File, error) {
+	objID, err := ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	file, err := uploads.Get(ctx, objID)
+	if err != nil {
+		return nil, err
+	}
+	if file.User != user.ID {
+		return nil, ErrNotFound
+	}
+
+	return file, nil
+}
+
+func handleFilesPage(c *fiber.Ctx) error {
+	token := c.Cookies("token", "")
+	if token == "" {
+		return c.Redirect("/login", 302)
+	}
+
+	parsedToken, err := parseJWT(token)
+	if err != nil {
+		c.ClearCookie("token")
+		return c.Redirect("/login", 302)
+	}
+
+	user, err := users.ByID(ctx, parsedToken.ID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("error: an unknown error occured")
+	}
+
+	chatList, err := chats.ListByUser(ctx, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("error: an unknown error occured")
+	}
+
+	files, err := listFiles(ctx, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("error: an unknown error occured")
+	}
+
+	return c.Render("files", fiber.Map{"Chats": chatList, "User": user, "Files": files})
+}
+
+func handleListFiles(c *fiber.Ctx) error {
+	user, err := apiUser(c)
+	if user == nil {
+		return err
+	}
+
+	files, err := listFiles(ctx, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured"})
+	}
+
+	quota, err := quotaStatus(ctx, user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured"})
+	}
+
+	return c.JSON(fiber.Map{"files": files, "quota": quota})
+}
+
+func handleRenameFile(c *fiber.Ctx) error {
+	user, err := apiUser(c)
+	if user == nil {
+		return err
+	}
+
+	var body struct {
+		Name string `json:"name" form:"name"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request"})
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > 255 || strings.ContainsAny(name, "/\\\x00") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "file names must be 1 to 255 characters without slashes"})
+	}
+
+	file, err := ownedFile(ctx, user, c.Params("id"))
+	if err == nil {
+		err = uploads.Rename(ctx, file.ID, name)
+	}
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "file not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured"})
+	}
+
+	return c.JSON(fiber.Map{"ok": "file renamed successfully", "id": file.ID.Hex(), "name": name})
+}
+
+func handleDeleteFile(c *fiber.Ctx) error {
+	user, err := apiUser(c)
+	if user == nil {
+		return err
+	}
+
+	deleted, err := deleteFiles(ctx, user, []string{c.Params("id")})
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "file not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured"})
+	}
+
+	return c.JSON(fiber.Map{"ok": "file deleted successfully", "deleted": deleted})
+}
+
+// handleDeleteFiles deletes every file listed in the request's "ids".
+func handleDeleteFiles(c *fiber.Ctx) error {
+	user, err := apiUser(c)
+	if user == nil {
+		return err
+	}
+
+	var body struct {
+		IDs []string `json:"ids" form:"ids"`
+	}
+	if err := c.BodyParser(&body); err != nil || len(body.IDs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "no files selected"})
+	}
+
+	deleted, err := deleteFiles(ctx, user, body.IDs)
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "file not found", "deleted": deleted})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured", "deleted": deleted})
+	}
+
+	return c.JSON(fiber.Map{"ok": "files deleted successfully", "deleted": deleted})
+}
+
+// deleteFiles deletes a user's files by hex ID and returns the IDs it
+// deleted. It checks every ID before deleting any, so a bad ID deletes
+// nothing. The blobs go through the garbage collector rather than being
+// deleted here: chats keep showing the files they attached, and other
+// uploads may share the contents.
+func deleteFiles(ctx context.Context, user *User, ids []string) ([]string, error) {
+	var files []*File
+	for _, id := range ids {
+		file, err := ownedFile(ctx, user, id)
+		if err != nil {
+			return []string{}, err
+		}
+		files = append(files, file)
+	}
+
+	deleted := []string{}
+	for _, file := range files {
+		if err := uploads.Delete(ctx, file.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			return deleted, err
+		}
+		deleted = append(deleted, file.ID.Hex())
+	}
+
+	if len(deleted) > 0 {
+		requestGC()
+	}
+	return deleted, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fileRequest sends a JSON request to the file manager API and returns the
+// status and decoded response.
+func fileRequest(t *testing.T, app *fiber.App, token, method, path, body string) (int, map[string]any) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cookie", "token="+token)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, result
+}
+
+func TestFileManager(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	user, err := users.ByEmail(ctx, "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, size, err := blobs.Put(ctx, strings.NewReader("lab notes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes := &File{User: user.ID, Name: "notes.txt", MIMEType: "text/plain", Size: size, Blob: key}
+	slides := &File{User: user.ID, Name: "slides.pdf", MIMEType: "application/pdf", Size: 1234, Blob: key}
+	theirs := &File{User: primitive.NewObjectID(), Name: "theirs.txt", Blob: key}
+	for _, file := range []*File{notes, slides, theirs} {
+		if err := uploads.Create(ctx, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attach := MessagePart{Type: PartFile, FileID: notes.ID, Blob: key, Name: notes.Name}
+	chat := &Chat{User: user.ID, Title: "Lab", Model: "fake"}
+	chat.add(newMessage("user", attach, textPart("summarize")))
+	if err := chats.Create(ctx, chat); err != nil {
+		t.Fatal(err)
+	}
+
+	status, result := fileRequest(t, app, token, "GET", "/api/files", "")
+	files, _ := result["files"].([]any)
+	if status != fiber.StatusOK || len(files) != 2 {
+		t.Fatalf("listing files got %d %v, want both of the user's files", status, result)
+	}
+	for _, f := range files {
+		file := f.(map[string]any)
+		chatList := file["chats"].([]any)
+		wantChats := 0
+		if file["id"] == notes.ID.Hex() {
+			wantChats = 1
+		}
+		if len(chatList) != wantChats {
+			t.Errorf("%s is listed in %v, want %d chats", file["name"], chatList, wantChats)
+		}
+	}
+
+	status, result = fileRequest(t, app, token, "PATCH", "/api/files/"+notes.ID.Hex(), `{"name": "lab notes.txt"}`)
+	if got, _ := uploads.Get(ctx, notes.ID); status != fiber.StatusOK || got.Name != "lab notes.txt" {
+		t.Errorf("renaming got %d %v", status, result)
+	}
+	status, _ = fileRequest(t, app, token, "PATCH", "/api/files/"+theirs.ID.Hex(), `{"name": "mine.txt"}`)
+	if status != fiber.StatusNotFound {
+		t.Errorf("renaming another user's file got status %d, want %d", status, fiber.StatusNotFound)
+	}
+
+	// One foreign ID makes the whole bulk delete fail.
+	status, _ = fileRequest(t, app, token, "POST", "/api/files/delete", `{"ids": ["`+notes.ID.Hex()+`", "`+theirs.ID.Hex()+`"]}`)
+	if _, err := uploads.Get(ctx, notes.ID); status != fiber.StatusNotFound || err != nil {
+		t.Errorf("bulk delete including another user's file got status %d and deleted notes.txt: %v", status, err)
+	}
+
+	status, result = fileRequest(t, app, token, "POST", "/api/files/delete", `{"ids": ["`+notes.ID.Hex()+`", "`+slides.ID.Hex()+`"]}`)
+	if status != fiber.StatusOK || len(result["deleted"].([]any)) != 2 {
+		t.Fatalf("bulk delete got %d %v", status, result)
+	}
+	if remaining, _ := uploads.ListByUser(ctx, user.ID); len(remaining) != 0 {
+		t.Errorf("%d files left after deleting all of them", len(remaining))
+	}
+
+	// The chat and another user's File still reference the blob.
+	if _, err := readBlob(ctx, key); err != nil {
+		t.Errorf("deleting files removed their shared blob: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/files", nil)
+	req.Header.Set("Cookie", "token="+token)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusOK || !strings.Contains(string(body), "You haven't uploaded any files yet.") {
+		t.Errorf("files page got %d:\n%s", resp.StatusCode, body)
+	}
+}
+
+func TestFileChats(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := openSQL(ctx, "sqlite:"+filepath.Join(t.TempDir(), "geminui.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	user := &User{Email: "student@example.com", StudentID: "1"}
+	if err := (&sqlUserStore{db: db}).Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	fileID := primitive.NewObjectID()
+	attach := MessagePart{Type: PartFile, FileID: fileID, Name: "notes.txt"}
+
+	for name, store := range map[string]ChatStore{"sql": &sqlChatStore{db: db}, "memory": newMemoryChatStore()} {
+		older := &Chat{User: user.ID, Title: "Older"}
+		older.add(
+			newMessage("user", attach, textPart("read this")),
+			newMessage("model", textPart("ok")),
+			newMessage("user", attach, textPart("again")),
+		)
+		newer := &Chat{User: user.ID, Title: "Newer"}
+		newer.add(newMessage("user", attach))
+		unrelated := &Chat{User: user.ID, Title: "Unrelated"}
+		unrelated.add(newMessage("user", textPart("hi")))
+		for _, chat := range []*Chat{older, newer, unrelated} {
+			if err := store.Create(ctx, chat); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		refs, err := store.FileChats(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := refs[fileID]
+		if len(refs) != 1 || len(got) != 2 || got[0].ID != newer.ID || got[0].Title != "Newer" || got[1].ID != older.ID {
+			t.Errorf("%s store FileChats = %+v, want the newer then the older chat", name, refs)
+		}
+	}
+}
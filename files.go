@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrUnsupportedAttachment is returned when a message has an attachment the
+// chosen model can't read.
+var ErrUnsupportedAttachment = errors.New("unsupported attachment")
+
+// isTextMIMEType reports whether files of a type are sent to models as text
+// rather than as inline data.
+func isTextMIMEType(mimeType string) bool {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	switch mimeType {
+	case "application/json", "application/xml", "application/javascript", "application/x-yaml":
+		return true
+	}
+
+	return strings.HasPrefix(mimeType, "text/")
+}
+
+// zipBasedTypes are formats that are zip archives inside, which content
+// sniffing only sees as application/zip.
+var zipBasedTypes = map[string]bool{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         true,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": true,
+	"application/vnd.oasis.opendocument.text":                                   true,
+	"application/vnd.oasis.opendocument.spreadsheet":                            true,
+	"application/vnd.oasis.opendocument.presentation":                           true,
+	"application/epub+zip": true,
+}
+
+// detectMIMEType works out an upload's type from its first bytes. The type
+// the browser claimed, or else the one implied by the file name, is only
+// used to refine what sniffing can't tell apart: the kind of text in a text
+// file, the format of a zip archive, or the type of data sniffing doesn't
+// recognize. A file whose contents contradict its claimed type gets the
+// sniffed type.
+func detectMIMEType(head []byte, claimed, name string) string {
+	sniffed := http.DetectContentType(head)
+
+	if claimed == "" || claimed == "application/octet-stream" {
+		claimed = mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	}
+	claimedBase, _, _ := strings.Cut(claimed, ";")
+	if claimedBase == "" {
+		return sniffed
+	}
+
+	switch {
+	case strings.HasPrefix(sniffed, "text/plain"):
+		if isTextMIMEType(claimed) {
+			return claimed
+		}
+	case sniffed == "application/zip":
+		if zipBasedTypes[claimedBase] {
+			return claimedBase
+		}
+	case sniffed == "application/octet-stream":
+		if !isTextMIMEType(claimed) {
+			return claimed
+		}
+	}
+
+	return sniffed
+}
+
+// attachmentParts looks up the uploads a user attached to a message and
+// returns the file parts referencing them.
+func attachmentParts(ctx context.Context, userID primitive.ObjectID, ids []string) ([]MessagePart, error) {
+	var parts []MessagePart
+	for _, id := range ids {
+		objID, err := ObjectIDFromHex(id)
+		if err != nil {
+			return nil, ErrNotFound
+		}
+
+		file, err := uploads.Get(ctx, objID)
+		if err != nil {
+			return nil, err
+		}
+		if file.User != userID {
+			return nil, ErrNotFound
+		}
+
+		parts = append(parts, MessagePart{Type: PartFile, FileID: file.ID, Blob: file.Blob, MIMEType: file.MIMEType, Name: file.Name})
+	}
+
+	return parts, nil
+}
+
+// readBlob reads a whole blob.
+func readBlob(ctx context.Context, key string) ([]byte, error) {
+	r, err := blobs.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// openUpload opens the contents of an uploaded file.
+func openUpload(ctx context.Context, file *File) (io.ReadCloser, error) {
+	if file.Blob == "" {
+		f, err := os.Open(file.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return f, err
+	}
+
+	return blobs.Open(ctx, file.Blob)
+}
+
+// readAttachment reads the contents of an attached file. The message keeps
+// the blob key, so the contents stay available after the File is deleted.
+func readAttachment(ctx context.Context, part MessagePart) ([]byte, error) {
+	key := part.Blob
+	if key == "" {
+		file, err := uploads.Get(ctx, part.FileID)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := openUpload(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		return io.ReadAll(r)
+	}
+
+	return readBlob(ctx, key)
+}
+
+// attachmentText returns the text of an attached document: the text
+// extracted on upload, or, once the File is gone, extracted again from the
+// blob the message kept.
+func attachmentText(ctx context.Context, part MessagePart) (string, error) {
+	if !part.FileID.IsZero() {
+		file, err := uploads.Get(ctx, part.FileID)
+		if err == nil && file.Text != "" {
+			return file.Text, nil
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return "", err
+		}
+	}
+
+	data, err := readAttachment(ctx, part)
+	if err != nil {
+		return "", err
+	}
+
+	return extractText(part.MIMEType, data)
+}
+
+// expandAttachments returns a copy of messages with file references replaced
+// by the file contents, which is what models are sent. Chats keep the
+// references so that every turn sends the files again. Text files become
+// delimited text parts, and so does the text of documents the model can't
+// read natively. Everything else is sent as inline data, limited to the types
+// the model's config accepts: attachments of the last message that it
+// doesn't are an error, earlier ones, sent when the chat had another model,
+// are replaced by a note saying so.
+func expandAttachments(ctx context.Context, config ModelConfig, messages []Message) ([]Message, error) {
+	expanded := make([]Message, len(messages))
+	for i, message := range messages {
+		expanded[i] = message
+		expanded[i].Parts = nil
+
+		for _, part := range message.Parts {
+			if part.Type != PartFile {
+				expanded[i].Parts = append(expanded[i].Parts, part)
+				continue
+			}
+
+			earlier := i < len(messages)-1
+			if !config.Accepts(part.MIMEType) && isDocumentMIMEType(part.MIMEType) {
+				text, err := attachmentText(ctx, part)
+				if err != nil && earlier {
+					expanded[i].Parts = append(expanded[i].Parts, unreadableNote(config, part))
+					continue
+				}
+				if err != nil {
+					return nil, fmt.Errorf("%w: %s can't read %s (%s) and its text couldn't be extracted: %v", ErrUnsupportedAttachment, config.Name, part.Name, part.MIMEType, err)
+				}
+				expanded[i].Parts = append(expanded[i].Parts, textPart(delimitedText(part.Name, text)))
+				continue
+			}
+
+			if !config.Accepts(part.MIMEType) && earlier {
+				expanded[i].Parts = append(expanded[i].Parts, unreadableNote(config, part))
+				continue
+			}
+			if !config.Accepts(part.MIMEType) {
+				return nil, fmt.Errorf("%w: %s can't read %s (%s)", ErrUnsupportedAttachment, config.Name, part.Name, part.MIMEType)
+			}
+
+			data, err := readAttachment(ctx, part)
+			if err != nil {
+				return nil, fmt.Errorf("attachment %s: %w", part.Name, err)
+			}
+
+			if isTextMIMEType(part.MIMEType) {
+				expanded[i].Parts = append(expanded[i].Parts, textPart(delimitedText(part.Name, string(data))))
+			} else {
+				expanded[i].Parts = append(expanded[i].Parts, MessagePart{Type: PartInlineData, MIMEType: part.MIMEType, Data: data})
+			}
+		}
+	}
+
+	return expanded, nil
+}
+
+// unreadableNote stands in for an attachment a model can't read, so that it
+// knows there was one.
+func unreadableNote(config ModelConfig, part MessagePart) MessagePart {
+	return textPart(fmt.Sprintf("[%s (%s) was attached here, but %s can't read it.]", part.Name, part.MIMEType, config.Name))
+}
+
+// attachmentWarning returns a warning for the user when messages have
+// attachments that the model can't read, not even as text, which it's sent
+// without. Documents are assumed to have text.
+func attachmentWarning(config ModelConfig, messages []Message) string {
+	var names []string
+	for _, message := range messages {
+		for _, part := range message.Parts {
+			if part.Type == PartFile && !config.Accepts(part.MIMEType) && !isDocumentMIMEType(part.MIMEType) && !slices.Contains(names, part.Name) {
+				names = append(names, part.Name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%s can't read %s from earlier in this conversation, so it won't see them.", config.Name, strings.Join(names, ", "))
+}
+
+// uploadContextWarning returns a warning for the user when the text of an
+// uploaded file alone probably doesn't fit in the model's context window.
+func uploadContextWarning(config ModelConfig, file *File) string {
+	var tokens int
+	switch {
+	case isTextMIMEType(file.MIMEType):
+		tokens = int(file.Size+3) / 4
+	case !config.Accepts(file.MIMEType) && file.Text != "":
+		tokens = estimateTokens(file.Text)
+	}
+	if config.ContextWindow <= 0 || tokens <= config.ContextWindow {
+		return ""
+	}
+
+	return fmt.Sprintf("%s is about %d tokens of text, more than the %d that %s can read, so the model won't see all of it.", file.Name, tokens, config.ContextWindow, config.Name)
+}
+
+// contextWarning returns a warning for the user when the text in messages
+// probably doesn't fit in the model's context window, or "" when it does or
+// the window isn't configured.
+func contextWarning(config ModelConfig, messages []Message) string {
+	if config.ContextWindow <= 0 {
+		return ""
+	}
+
+	tokens := 0
+	for _, message := range messages {
+		for _, part := range message.Parts {
+			tokens += estimateTokens(part.Text)
+		}
+	}
+	if tokens <= config.ContextWindow {
+		return ""
+	}
+
+	return fmt.Sprintf("This conversation and its files are about %d tokens, more than the %d that %s can read, so the model may not see all of it.", tokens, config.ContextWindow, config.Name)
+}
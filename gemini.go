@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+type geminiProvider struct {
+	client *genai.Client
+}
+
+type geminiModel struct {
+	model *genai.GenerativeModel
+}
+
+type geminiSession struct {
+	cs *genai.ChatSession
+}
+
+type geminiStream struct {
+	iter *genai.GenerateContentResponseIterator
+}
+
+func newGeminiProvider(ctx context.Context, apiKey string) (*geminiProvider, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return &geminiProvider{client: client}, nil
+}
+
+func (p *geminiProvider) Model(name string, config GenerationConfig) ChatModel {
+	model := p.client.GenerativeModel(name)
+	model.Temperature = config.Temperature
+	model.TopP = config.TopP
+	model.TopK = config.TopK
+	model.MaxOutputTokens = config.MaxOutputTokens
+
+	return &geminiModel{model: model}
+}
+
+func (p *geminiProvider) Close() error {
+	return p.client.Close()
+}
+
+// withOptions returns a shallow copy of the shared genai model with the
+// request's options applied.
+func (m *geminiModel) withOptions(opts ChatOptions) *genai.GenerativeModel {
+	model := *m.model
+	if opts.SystemInstruction != "" {
+		model.SystemInstruction = &genai.Content{
+			Parts: []genai.Part{genai.Text(opts.SystemInstruction)},
+		}
+	}
+
+	return &model
+}
+
+func (m *geminiModel) StartChat(opts ChatOptions, history []Message) ChatSession {
+	cs := m.withOptions(opts).StartChat()
+	cs.History = convertToGenaiContent(history)
+	return &geminiSession{cs: cs}
+}
+
+func (m *geminiModel) GenerateContent(ctx context.Context, opts ChatOptions, prompt string) (string, error) {
+	response, err := m.withOptions(opts).GenerateContent(ctx, genai.Text(prompt))
+	if err != nil {
+		return "", err
+	}
+
+	if len(response.Candidates) == 0 || response.Candidates[0].Content == nil {
+		return "", fmt.Errorf("gemini: empty response")
+	}
+
+	message := Message{Parts: convertFromGenaiParts(response.Candidates[0].Content.Parts)}
+	return message.Text(), nil
+}
+
+func (m *geminiModel) CountTokens(ctx context.Context, text string) (int, error) {
+	response, err := m.model.CountTokens(ctx, genai.Text(text))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.TotalTokens), nil
+}
+
+func (s *geminiSession) SendMessageStream(ctx context.Context, message Message) Stream {
+	return &geminiStream{iter: s.cs.SendMessageStream(ctx, convertToGenaiParts(message.Parts)...)}
+}
+
+func (s *geminiStream) Next() (*Chunk, error) {
+	resp, err := s.iter.Next()
+	if err == iterator.Done {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return geminiChunk(resp), nil
+}
+
+func geminiChunk(resp *genai.GenerateContentResponse) *Chunk {
+	chunk := &Chunk{}
+	if resp.UsageMetadata != nil {
+		chunk.Usage = &TokenUsage{
+			PromptTokens:    int(resp.UsageMetadata.PromptTokenCount),
+			CandidateTokens: int(resp.UsageMetadata.CandidatesTokenCount),
+			TotalTokens:     int(resp.UsageMetadata.TotalTokenCount),
+		}
+	}
+
+	if len(resp.Candidates) == 0 {
+		return chunk
+	}
+
+	candidate := resp.Candidates[0]
+	if candidate.Content != nil {
+		chunk.Parts = convertFromGenaiParts(candidate.Content.Parts)
+	}
+	chunk.FinishReason = geminiFinishReason(candidate.FinishReason)
+	for _, rating := range candidate.SafetyRatings {
+		chunk.SafetyRatings = append(chunk.SafetyRatings, SafetyRating{
+			Category:    rating.Category.String(),
+			Probability: rating.Probability.String(),
+			Blocked:     rating.Blocked,
+		})
+	}
+
+	return chunk
+}
+
+func geminiFinishReason(reason genai.FinishReason) string {
+	switch reason {
+	case genai.FinishReasonUnspecified:
+		return ""
+	case genai.FinishReasonStop:
+		return FinishStop
+	case genai.FinishReasonMaxTokens:
+		return FinishMaxTokens
+	case genai.FinishReasonSafety, genai.FinishReasonRecitation:
+		return FinishSafety
+	default:
+		return FinishOther
+	}
+}
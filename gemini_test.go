@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestGeminiOptionsDoNotMutateSharedModel(t *testing.T) {
+	shared := &geminiModel{model: &genai.GenerativeModel{}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(instruction string) {
+			defer wg.Done()
+
+			model := shared.withOptions(ChatOptions{SystemInstruction: instruction})
+			got := fmt.Sprint(model.SystemInstruction.Parts[0])
+			if got != instruction {
+				t.Errorf("got system instruction %q, want %q", got, instruction)
+			}
+		}(fmt.Sprintf("request %d", i))
+	}
+	wg.Wait()
+
+	if shared.model.SystemInstruction != nil {
+		t.Errorf("shared model was given system instruction %v", shared.model.SystemInstruction)
+	}
+}
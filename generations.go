@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// generationRetention is how long a finished generation's events are kept,
+// so that a client that lost its connection near the end can still get
+// them.
+var generationRetention = 5 * time.Minute
+
+// generationAbandonment is how long a generation carries on with no client
+// following it, long enough for a dropped connection to come back. After
+// that it's stopped, so that answers nobody reads aren't paid for, and
+// what was generated is saved.
+var generationAbandonment = 2 * time.Minute
+
+var errChatBusy = errors.New("an answer is still being generated in this chat")
+
+// generation is an answer being generated by a model. It runs on its own,
+// whether or not a client is following it, up to generationAbandonment
+// without one, and buffers its events so that clients can reconnect and
+// resume from the last one they got.
+type generation struct {
+	id     primitive.ObjectID // of the reply
+	user   primitive.ObjectID
+	chat   primitive.ObjectID
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	events    []bufferedEvent
+	done      bool
+	changed   chan struct{} // closed and replaced whenever an event is added
+	followers int
+	abandon   *time.Timer // stops the generation while nobody follows it
+}
+
+// bufferedEvent is a server-sent event with its ID, its position in the
+// generation's events counting from 1.
+type bufferedEvent struct {
+	id   int
+	name string
+	data any
+}
+
+func newGeneration(id, user, chat primitive.ObjectID, cancel context.CancelFunc) *generation {
+	return &generation{
+		id:      id,
+		user:    user,
+		chat:    chat,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+		abandon: time.AfterFunc(generationAbandonment, cancel),
+	}
+}
+
+// attach counts a client following the generation, until the returned
+// function is called.
+func (g *generation) attach() (detach func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.followers++
+	g.abandon.Stop()
+
+	return sync.OnceFunc(func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		g.followers--
+		if g.followers == 0 && !g.done {
+			g.abandon.Reset(generationAbandonment)
+		}
+	})
+}
+
+// emit adds an event for the clients following the generation.
+func (g *generation) emit(name string, data any) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.events = append(g.events, bufferedEvent{id: len(g.events) + 1, name: name, data: data})
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// finish marks the generation done, after its last event.
+func (g *generation) finish() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.done = true
+	g.abandon.Stop()
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// after returns the events after the one with ID last, whether the
+// generation is done, and a channel closed once there's more to read.
+func (g *generation) after(last int) ([]bufferedEvent, bool, <-chan struct{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	last = min(max(last, 0), len(g.events))
+	return g.events[last:], g.done, g.changed
+}
+
+// run sends the question, with its attachments' contents, to the model,
+// streams the reply into the generation's events and saves it to the chat,
+// whose leaf is already the question. Replies cut short keep what was
+// generated; if nothing was, the chat's messages and leaf are put back to
+// previous's, or the chat deleted if it was new.
+func (g *generation) run(ctx context.Context, session ChatSession, question Message, chat *Chat, reply Message, previous Chat, newChat bool) {
+	defer g.cancel()
+	defer g.finish()
+	defer time.AfterFunc(generationRetention, func() { generations.remove(g.id) })
+
+	stream := session.SendMessageStream(ctx, question)
+	for {
+		chunk, err := stream.Next()
+		if ctx.Err() != nil {
+			reply.FinishReason = FinishStopped
+			break
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error generating answer: %v", err)
+			g.emit(EventError, map[string]any{"code": ErrorCodeModel, "message": "an error occured: " + err.Error()})
+			reply.FinishReason = FinishOther
+			break
+		}
+
+		reply.appendChunk(chunk)
+
+		var text string
+		for _, part := range chunk.Parts {
+			text += part.Markdown()
+		}
+		if text != "" {
+			g.emit(EventDelta, map[string]any{"text": text})
+		}
+	}
+
+	if reply.Usage != nil {
+		g.emit(EventUsage, reply.Usage)
+	}
+
+	// The chat is saved with the store's context, not the generation's,
+	// which is cancelled when the user stops it.
+	var err error
+	switch {
+	case len(reply.Parts) > 0:
+		chat.add(reply)
+		err = chats.UpdateMessages(context.WithoutCancel(ctx), chat.ID, chat.Messages, chat.Leaf)
+	case newChat:
+		err = chats.Delete(context.WithoutCancel(ctx), chat.ID)
+		if err == nil {
+			hub.broadcast(g.user, map[string]any{"type": HubChatDeleted, "chatId": chat.ID.Hex()}, nil)
+		}
+	default:
+		err = chats.UpdateMessages(context.WithoutCancel(ctx), chat.ID, previous.Messages, previous.Leaf)
+	}
+	if err != nil {
+		log.Printf("Error saving chat %s: %v", chat.ID.Hex(), err)
+		g.emit(EventError, map[string]any{"code": ErrorCodeSave, "message": "the answer couldn't be saved"})
+	}
+
+	g.emit(EventDone, map[string]any{"finishReason": reply.FinishReason})
+}
+
+// generationRegistry tracks the generations by the ID of the reply they're
+// writing, so that clients can follow and stop them from other requests.
+type generationRegistry struct {
+	mu      sync.Mutex
+	running map[primitive.ObjectID]*generation
+}
+
+var generations = &generationRegistry{running: make(map[primitive.ObjectID]*generation)}
+
+// tryAdd registers a generation, unless another is still running in its
+// chat: answers are saved over the history they started from, so only one is
+// generated in a chat at a time.
+func (r *generationRegistry) tryAdd(g *generation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, busy := r.runningIn(g.chat); busy {
+		return errChatBusy
+	}
+	r.running[g.id] = g
+	return nil
+}
+
+// remove forgets a generation once its events are no longer needed.
+func (r *generationRegistry) remove(id primitive.ObjectID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.running, id)
+}
+
+// get returns one of a user's generations.
+func (r *generationRegistry) get(id, user primitive.ObjectID) (*generation, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	g, ok := r.running[id]
+	if !ok || g.user != user {
+		return nil, false
+	}
+	return g, true
+}
+
+// forChat returns the generation still running in a chat, if any.
+func (r *generationRegistry) forChat(chat primitive.ObjectID) (*generation, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.runningIn(chat)
+}
+
+// runningIn is forChat for callers holding r.mu.
+func (r *generationRegistry) runningIn(chat primitive.ObjectID) (*generation, bool) {
+	for _, g := range r.running {
+		if g.chat == chat {
+			if _, done, _ := g.after(0); !done {
+				return g, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// stop cancels one of a user's generations. It reports false if the user
+// has no such generation running, including when it has already finished.
+func (r *generationRegistry) stop(id, user primitive.ObjectID) bool {
+	g, ok := r.get(id, user)
+	if !ok {
+		return false
+	}
+	if _, done, _ := g.after(0); done {
+		return false
+	}
+
+	g.cancel()
+	return true
+}
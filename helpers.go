@@ -3,15 +3,19 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"html/template"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/generative-ai-go/genai"
 	"github.com/google/uuid"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/mailjet/mailjet-apiv3-go/v4"
@@ -62,19 +66,12 @@ func parseJWT(tokenString string) (*TokenInfo, error) {
 		jti := claims["jti"].(string)
 		expiration, _ := claims.GetExpirationTime()
 
-		var result bson.M
-		users.FindOne(context.TODO(), bson.D{{Key: "email", Value: email}}).Decode(&result)
-
-		jtis := result["jtis"]
-
-		found := false
-		for _, value := range jtis.(bson.A) {
-			if value == jti {
-				found = true
-				break
-			}
+		user, err := users.ByEmail(context.TODO(), email)
+		if err != nil {
+			return nil, errors.New("invalid token")
 		}
-		if !found {
+
+		if !slices.Contains(user.JTI, jti) {
 			return nil, errors.New("expired token")
 		}
 
@@ -85,7 +82,7 @@ func parseJWT(tokenString string) (*TokenInfo, error) {
 		tokenInfo = &TokenInfo{
 			Email: email,
 			jti:   jti,
-			ID:    result["_id"].(primitive.ObjectID),
+			ID:    user.ID,
 		}
 	} else {
 		return nil, errors.New("invalid token")
@@ -94,6 +91,28 @@ func parseJWT(tokenString string) (*TokenInfo, error) {
 	return tokenInfo, nil
 }
 
+// apiUser returns the user logged in to an API request, or writes an
+// unauthorized JSON error and returns nil.
+func apiUser(c *fiber.Ctx) (*User, error) {
+	token := c.Cookies("token", "")
+	if token == "" {
+		return nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+
+	parsedToken, err := parseJWT(token)
+	if err != nil {
+		c.ClearCookie("token")
+		return nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+
+	user, err := users.ByEmail(ctx, parsedToken.Email)
+	if err != nil {
+		return nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+
+	return user, nil
+}
+
 func generateSecret(length int) string {
 	b := make([]byte, length)
 	if _, err := rand.Read(b); err != nil {
@@ -121,6 +140,20 @@ func ObjectIDToString(i primitive.ObjectID) string {
 	return i.Hex()
 }
 
+// formValues returns every value of a form field, from either a multipart or
+// a URL-encoded body.
+func formValues(c *fiber.Ctx, key string) []string {
+	if form, err := c.MultipartForm(); err == nil {
+		return form.Value[key]
+	}
+
+	var values []string
+	for _, value := range c.Request().PostArgs().PeekMulti(key) {
+		values = append(values, string(value))
+	}
+	return values
+}
+
 func ObjectIDFromHex(s string) (primitive.ObjectID, error) {
 	objID, err := primitive.ObjectIDFromHex(s)
 	if err != nil {
@@ -131,10 +164,8 @@ func ObjectIDFromHex(s string) (primitive.ObjectID, error) {
 }
 
 func sendVerificationEmail(email, name, otp string) (*mailjet.ResultsV31, string, error) {
-	verifDoc, err := emailVerification.InsertOne(ctx, bson.D{
-		{Key: "email", Value: email},
-		{Key: "code", Value: otp},
-	})
+	verification := &Verification{Email: email, Code: otp}
+	err := emailVerification.Create(ctx, verification)
 	if err != nil {
 		return nil, "", err
 	}
@@ -161,30 +192,93 @@ func sendVerificationEmail(email, name, otp string) (*mailjet.ResultsV31, string
 		return nil, "", err
 	}
 
-	return mail, verifDoc.InsertedID.(primitive.ObjectID).Hex(), nil
+	return mail, verification.ID.Hex(), nil
 }
 
-func convertToGenaiContent(history []Content) []*genai.Content {
+func convertToGenaiContent(history []Message) []*genai.Content {
 	var content []*genai.Content
 	for _, v := range history {
-		content = append(
-			content, &genai.Content{
-				Parts: []genai.Part{
-					genai.Text(v.Parts[0]),
-				},
-				Role: v.Role,
-			},
-		)
+		parts := convertToGenaiParts(v.Parts)
+		if len(parts) == 0 {
+			continue
+		}
+
+		content = append(content, &genai.Content{Parts: parts, Role: v.Role})
 	}
 	return content
 }
 
-func convertToInterface(history []*genai.Content) []interface{} {
-	var content []interface{}
-	for _, v := range history {
-		content = append(content, v)
+// genaiLanguages and genaiOutcomes name genai's enums in stored messages.
+var genaiLanguages = map[genai.ExecutableCodeLanguage]string{
+	genai.ExecutableCodePython: "python",
+}
+
+var genaiOutcomes = map[genai.CodeExecutionResultOutcome]string{
+	genai.CodeExecutionResultOutcomeOK:               "ok",
+	genai.CodeExecutionResultOutcomeFailed:           "failed",
+	genai.CodeExecutionResultOutcomeDeadlineExceeded: "deadline_exceeded",
+}
+
+func convertToGenaiParts(parts []MessagePart) []genai.Part {
+	var converted []genai.Part
+	for _, part := range parts {
+		switch part.Type {
+		case PartText:
+			converted = append(converted, genai.Text(part.Text))
+		case PartInlineData:
+			converted = append(converted, genai.Blob{MIMEType: part.MIMEType, Data: part.Data})
+		case PartFileData:
+			converted = append(converted, genai.FileData{MIMEType: part.MIMEType, URI: part.URI})
+		case PartFunctionCall:
+			converted = append(converted, genai.FunctionCall{Name: part.Name, Args: part.Args})
+		case PartFunctionResponse:
+			converted = append(converted, genai.FunctionResponse{Name: part.Name, Response: part.Response})
+		case PartExecutableCode:
+			code := genai.ExecutableCode{Code: part.Text}
+			for language, name := range genaiLanguages {
+				if name == part.Language {
+					code.Language = language
+				}
+			}
+			converted = append(converted, code)
+		case PartCodeExecutionResult:
+			result := genai.CodeExecutionResult{Output: part.Text}
+			for outcome, name := range genaiOutcomes {
+				if name == part.Outcome {
+					result.Outcome = outcome
+				}
+			}
+			converted = append(converted, result)
+		}
 	}
-	return content
+	return converted
+}
+
+func convertFromGenaiParts(parts []genai.Part) []MessagePart {
+	var converted []MessagePart
+	for _, part := range parts {
+		switch v := part.(type) {
+		case genai.Text:
+			converted = append(converted, textPart(string(v)))
+		case genai.Blob:
+			converted = append(converted, MessagePart{Type: PartInlineData, MIMEType: v.MIMEType, Data: v.Data})
+		case genai.FileData:
+			converted = append(converted, MessagePart{Type: PartFileData, MIMEType: v.MIMEType, URI: v.URI})
+		case genai.FunctionCall:
+			converted = append(converted, MessagePart{Type: PartFunctionCall, Name: v.Name, Args: v.Args})
+		case genai.FunctionResponse:
+			converted = append(converted, MessagePart{Type: PartFunctionResponse, Name: v.Name, Response: v.Response})
+		case *genai.ExecutableCode:
+			converted = append(converted, MessagePart{Type: PartExecutableCode, Language: genaiLanguages[v.Language], Text: v.Code})
+		case genai.ExecutableCode:
+			converted = append(converted, MessagePart{Type: PartExecutableCode, Language: genaiLanguages[v.Language], Text: v.Code})
+		case *genai.CodeExecutionResult:
+			converted = append(converted, MessagePart{Type: PartCodeExecutionResult, Outcome: genaiOutcomes[v.Outcome], Text: v.Output})
+		case genai.CodeExecutionResult:
+			converted = append(converted, MessagePart{Type: PartCodeExecutionResult, Outcome: genaiOutcomes[v.Outcome], Text: v.Output})
+		}
+	}
+	return converted
 }
 
 func markdownToHTML(text string) string {
@@ -193,13 +287,23 @@ func markdownToHTML(text string) string {
 	return string(html)
 }
 
-func reverse[T any](list []T) []T {
-	for i, j := 0, len(list)-1; i < j; {
-		list[i], list[j] = list[j], list[i]
-		i++
-		j--
+// dataURL embeds inline image data in a page. Other data isn't shown inline,
+// so it gets an empty URL.
+func dataURL(mimeType string, data []byte) template.URL {
+	if !strings.HasPrefix(mimeType, "image/") {
+		return ""
+	}
+
+	return template.URL("data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data))
+}
+
+func toJSON(v any) string {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err.Error()
 	}
-	return list
+
+	return string(data)
 }
 
 func replace(input, from, to string) string {
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Messages of the WebSocket at /api/ws, each a JSON object with its kind in
+// "type". Every tab a user has open keeps one, and sees what happens in the
+// others through it.
+//
+// Clients send:
+//
+//   - send: {"requestId", "chatId", "question", "model", "files"}, a question
+//     as for /api/ask, with "new" or no chatId for a new chat
+//   - edit: {"requestId", "chatId", "messageId", "question", "model",
+//     "files"}, adds an alternative to that question, as
+//     /api/chats/:id/messages/:message/edit does
+//   - regenerate: {"requestId", "chatId", "messageId", "model"}, answers
+//     again the question of that reply
+//   - cancel: {"messageId"}, stops generating that reply
+//   - typing: {"chatId", "typing"}, passed on to the user's other tabs
+//   - follow: {"messageId", "after"}, streams a generation's events after
+//     the one with ID after, for tabs showing a chat whose question was sent
+//     from elsewhere, or that connected while it was running
+//
+// The server sends:
+//
+//   - message: {"requestId", "chatId", "messageId", "parent", "model",
+//     "message", "warning"}, a question sent from any tab, with the requestId
+//     of the tab that sent it. parent is the ID of the message it follows,
+//     empty for the first; the chat's branch now goes through it. messageId
+//     is the reply's, and model the one answering. The generation's events
+//     follow on the connection the question was sent over; other tabs
+//     showing the chat send follow for them
+//   - meta, delta, usage, error, done: {"messageId", "eventId", "data"}, the
+//     events of /api/ask for the reply with that ID
+//   - rejected: {"requestId", "message"}, a send that was refused
+//   - typing: {"chatId", "typing"}
+//   - chat_created: {"chatId", "title"}
+//   - chat_renamed: {"chatId", "title"}
+//   - chat_deleted: {"chatId"}
+//   - branch_selected: {"chatId", "leaf"}, another branch of the chat is
+//     shown, ending with leaf
+const (
+	HubSend       = "send"
+	HubEdit       = "edit"
+	HubRegenerate = "regenerate"
+	HubCancel     = "cancel"
+	HubTyping     = "typing"
+	HubFollow     = "follow"
+	HubMessage    = "message"
+	HubRejected   = "rejected"
+
+	HubChatCreated = "chat_created"
+	HubChatRenamed = "chat_renamed"
+	HubChatDeleted = "chat_deleted"
+
+	HubBranchSelected = "branch_selected"
+)
+
+// hubPing is how often connections are pinged, so that proxies keep them
+// open and dead ones are noticed. A connection that doesn't answer two in a
+// row is closed.
+var hubPing = 30 * time.Second
+
+// hubQueue is how many messages may wait to be written to a connection. A
+// client that falls that far behind is disconnected; it reloads what it
+// missed when it reconnects.
+const hubQueue = 256
+
+// hubCommand is a message from a client.
+type hubCommand struct {
+	Type      string   `json:"type"`
+	RequestID string   `json:"requestId"`
+	ChatID    string   `json:"chatId"`
+	MessageID string   `json:"messageId"`
+	Question  string   `json:"question"`
+	Model     string   `json:"model"`
+	Files     []string `json:"files"`
+	Typing    bool     `json:"typing"`
+	After     int      `json:"after"`
+}
+
+// chatHub keeps every user's open connections, to tell each of their tabs
+// about what happens in the others.
+type chatHub struct {
+	mu    sync.Mutex
+	conns map[primitive.ObjectID]map[*hubConn]struct{}
+}
+
+var hub = &chatHub{conns: make(map[primitive.ObjectID]map[*hubConn]struct{})}
+
+func (h *chatHub) add(c *hubConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conns[c.user] == nil {
+		h.conns[c.user] = make(map[*hubConn]struct{})
+	}
+	h.conns[c.user][c] = struct{}{}
+}
+
+func (h *chatHub) remove(c *hubConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.conns[c.user], c)
+	if len(h.conns[c.user]) == 0 {
+		delete(h.conns, c.user)
+	}
+}
+
+// userConns returns a user's connections, except skip, which may be nil.
+func (h *chatHub) userConns(user primitive.ObjectID, skip *hubConn) []*hubConn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	conns := make([]*hubConn, 0, len(h.conns[user]))
+	for c := range h.conns[user] {
+		if c != skip {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// broadcast sends a message to a user's connections, except skip, which may
+// be nil.
+func (h *chatHub) broadcast(user primitive.ObjectID, message fiber.Map, skip *hubConn) {
+	for _, c := range h.userConns(user, skip) {
+		c.push(message)
+	}
+}
+
+// started tells a user's connections about a question they asked. Only
+// asker, the connection it was sent over if any, streams the generation
+// answering it; the others follow it if they're showing the chat, so that
+// tabs left open elsewhere don't keep an answer nobody reads going.
+func (h *chatHub) started(g *generation, asker *hubConn, message fiber.Map) {
+	for _, c := range h.userConns(g.user, nil) {
+		c.push(message)
+	}
+	if asker != nil {
+		asker.follow(g, 0)
+	}
+}
+
+// hubConn is one of a user's open WebSockets. Messages to it are queued and
+// written by its own goroutine, so that a slow client doesn't hold up the
+// others.
+type hubConn struct {
+	user primitive.ObjectID
+	out  chan any
+	done chan struct{}
+	once sync.Once
+
+	mu        sync.Mutex
+	following map[primitive.ObjectID]bool
+}
+
+func newHubConn(user primitive.ObjectID) *hubConn {
+	return &hubConn{
+		user:      user,
+		out:       make(chan any, hubQueue),
+		done:      make(chan struct{}),
+		following: make(map[primitive.ObjectID]bool),
+	}
+}
+
+// close stops the connection's writer and followers. It can be called more
+// than once.
+func (c *hubConn) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// push queues a message, closing the connection if its queue is full.
+func (c *hubConn) push(message any) {
+	select {
+	case c.out <- message:
+	case <-c.done:
+	default:
+		log.Printf("Closing a WebSocket that fell behind")
+		c.close()
+	}
+}
+
+// follow streams a generation's events after the one with ID last, until
+// it's done or the connection closes. A generation the connection is already
+// following is left alone.
+func (c *hubConn) follow(g *generation, last int) {
+	c.mu.Lock()
+	if c.following[g.id] {
+		c.mu.Unlock()
+		return
+	}
+	c.following[g.id] = true
+	c.mu.Unlock()
+
+	detach := g.attach()
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.following, g.id)
+			c.mu.Unlock()
+		}()
+		defer detach()
+
+		messageID := g.id.Hex()
+		for {
+			events, done, changed := g.after(last)
+			for _, event := range events {
+				// Unlike push, this waits for room in the queue: the
+				// generation keeps its events until the client gets them.
+				select {
+				case c.out <- fiber.Map{"type": event.name, "messageId": messageID, "eventId": event.id, "data": event.data}:
+				case <-c.done:
+					return
+				}
+				last = event.id
+			}
+			if done {
+				return
+			}
+
+			select {
+			case <-changed:
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+// write sends the queued messages and the pings until the connection
+// closes, then closes the WebSocket.
+func (c *hubConn) write(ws *websocket.Conn) {
+	ping := time.NewTicker(hubPing)
+	defer ping.Stop()
+	defer ws.Close()
+
+	for {
+		var err error
+		select {
+		case message := <-c.out:
+			ws.SetWriteDeadline(time.Now().Add(hubPing))
+			err = ws.WriteJSON(message)
+		case <-ping.C:
+			err = ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(hubPing))
+		case <-c.done:
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return
+		}
+		if err != nil {
+			c.close()
+			return
+		}
+	}
+}
+
+// handle carries out a client's message.
+func (c *hubConn) handle(cmd hubCommand) {
+	switch cmd.Type {
+	case HubSend, HubEdit, HubRegenerate:
+		req := askRequest{
+			Chat:      cmd.ChatID,
+			Question:  cmd.Question,
+			Model:     cmd.Model,
+			Files:     cmd.Files,
+			RequestID: cmd.RequestID,
+			At:        cmd.MessageID,
+			Conn:      c,
+		}
+		switch cmd.Type {
+		case HubEdit:
+			req.Rewind = rewindEdit
+		case HubRegenerate:
+			req.Rewind = rewindRegenerate
+		}
+
+		// Starting an answer reads the attachments and may have the
+		// summarizer title a new chat, which shouldn't hold up the
+		// connection's other messages, like cancelling.
+		go c.ask(req)
+
+	case HubCancel:
+		// Stopping a generation that isn't running does nothing; the tab
+		// finds out from its done event, or lack of one.
+		if id, err := ObjectIDFromHex(cmd.MessageID); err == nil {
+			generations.stop(id, c.user)
+		}
+
+	case HubTyping:
+		hub.broadcast(c.user, fiber.Map{"type": HubTyping, "chatId": cmd.ChatID, "typing": cmd.Typing}, c)
+
+	case HubFollow:
+		if id, err := ObjectIDFromHex(cmd.MessageID); err == nil {
+			if g, ok := generations.get(id, c.user); ok {
+				c.follow(g, cmd.After)
+			}
+		}
+	}
+}
+
+// ask starts answering a question sent over the connection. The question
+// and the answer reach the connection like any other tab's; only a refusal
+// is sent to it alone.
+func (c *hubConn) ask(req askRequest) {
+	user, err := users.ByID(ctx, c.user)
+	if err != nil {
+		c.push(fiber.Map{"type": HubRejected, "requestId": req.RequestID, "message": "an unknown error occured"})
+		return
+	}
+
+	if _, _, err := startAsk(user, req); err != nil {
+		c.push(fiber.Map{"type": HubRejected, "requestId": req.RequestID, "message": err.Error()})
+	}
+}
+
+// handleHubUpgrade lets logged in users open the WebSocket, from the site's
+// own pages only: browsers send cookies along with WebSockets opened by any
+// site.
+func handleHubUpgrade(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+
+	if origin := c.Get(fiber.HeaderOrigin); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, string(c.Request().Host())) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "forbidden"})
+		}
+	}
+
+	user, err := apiUser(c)
+	if user == nil {
+		return err
+	}
+
+	c.Locals("user", user.ID)
+	return c.Next()
+}
+
+// handleHub serves one of a user's WebSockets until it closes.
+func handleHub(ws *websocket.Conn) {
+	conn := newHubConn(ws.Locals("user").(primitive.ObjectID))
+	hub.add(conn)
+	defer hub.remove(conn)
+
+	// The WebSocket is reused once this returns, so the writer has to be
+	// done with it by then.
+	written := make(chan struct{})
+	go func() {
+		conn.write(ws)
+		close(written)
+	}()
+	defer func() {
+		conn.close()
+		<-written
+	}()
+
+	ws.SetReadDeadline(time.Now().Add(2 * hubPing))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(2 * hubPing))
+	})
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(2 * hubPing))
+
+		var cmd hubCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			continue
+		}
+		conn.handle(cmd)
+	}
+}
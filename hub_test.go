@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// dialHub serves the app on a local port and opens a WebSocket to it with
+// the login token, as a tab would.
+func dialHub(t *testing.T, app *fiber.App, token string) (string, func() *websocket.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+
+	addr := ln.Addr().String()
+	return addr, func() *websocket.Conn {
+		t.Helper()
+
+		header := http.Header{"Cookie": {"token=" + token}}
+		ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/api/ws", header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		return ws
+	}
+}
+
+// readHub reads a tab's messages until one of the given type, which it
+// returns, skipping the others.
+func readHub(t *testing.T, ws *websocket.Conn, kind string) map[string]any {
+	t.Helper()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var message map[string]any
+		if err := ws.ReadJSON(&message); err != nil {
+			t.Fatalf("waiting for %s: %v", kind, err)
+		}
+		if message["type"] == kind {
+			return message
+		}
+	}
+}
+
+// waitForTabs waits for the hub to have a user's n tabs, which it only adds
+// once the handshake is over.
+func waitForTabs(t *testing.T, email string, n int) {
+	t.Helper()
+
+	user, err := users.ByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if len(hub.userConns(user.ID, nil)) == n {
+			return
+		}
+	}
+	t.Fatalf("the hub never had %d tabs", n)
+}
+
+func TestHubSyncsTabs(t *testing.T) {
+	app, token := newTestApp(t)
+	addr, dial := dialHub(t, app, token)
+	sender, other := dial(), dial()
+	waitForTabs(t, "student@example.com", 2)
+
+	err := sender.WriteJSON(map[string]any{"type": HubSend, "requestId": "r1", "chatId": "new", "question": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both tabs get the new chat, the question and, the other one once it
+	// follows it, the whole answer.
+	var chatID string
+	for _, ws := range []*websocket.Conn{sender, other} {
+		created := readHub(t, ws, HubChatCreated)
+		message := readHub(t, ws, HubMessage)
+		if message["requestId"] != "r1" || message["chatId"] != created["chatId"] {
+			t.Errorf("got %+v after %+v, want the question in the new chat", message, created)
+		}
+		chatID = created["chatId"].(string)
+		if ws == other {
+			if err := ws.WriteJSON(map[string]any{"type": HubFollow, "messageId": message["messageId"]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var answer string
+		for {
+			var event map[string]any
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err := ws.ReadJSON(&event); err != nil {
+				t.Fatal(err)
+			}
+			if event["messageId"] != message["messageId"] {
+				t.Fatalf("got %+v while answering %s", event, message["messageId"])
+			}
+			if event["type"] == EventDelta {
+				answer += event["data"].(map[string]any)["text"].(string)
+			}
+			if event["type"] == EventDone {
+				break
+			}
+		}
+		if !strings.HasSuffix(answer, "hello") {
+			t.Errorf("streamed answer %q", answer)
+		}
+	}
+
+	// Typing is only passed on to the other tabs.
+	if err := sender.WriteJSON(map[string]any{"type": HubTyping, "chatId": chatID, "typing": true}); err != nil {
+		t.Fatal(err)
+	}
+	if typing := readHub(t, other, HubTyping); typing["chatId"] != chatID || typing["typing"] != true {
+		t.Errorf("other tab got %+v", typing)
+	}
+
+	// Changes made over HTTP reach every tab too.
+	req := httptest.NewRequest("PATCH", "/api/chats/"+chatID, strings.NewReader(url.Values{"title": {"Greetings"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("PATCH /api/chats/%s: %d", chatID, resp.StatusCode)
+	}
+	for _, ws := range []*websocket.Conn{sender, other} {
+		if renamed := readHub(t, ws, HubChatRenamed); renamed["chatId"] != chatID || renamed["title"] != "Greetings" {
+			t.Errorf("got %+v, want the new title", renamed)
+		}
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/delete/"+chatID, nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	if _, err := app.Test(req, -1); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := readHub(t, other, HubChatDeleted); deleted["chatId"] != chatID {
+		t.Errorf("got %+v, want chat %s deleted", deleted, chatID)
+	}
+
+	// Pages of other sites can't use the student's cookie.
+	header := http.Header{"Cookie": {"token=" + token}, "Origin": {"https://evil.example"}}
+	if _, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/api/ws", header); err == nil || resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("cross-site WebSocket got %v, want it refused", err)
+	}
+}
+
+func TestHubReadsWhileAsking(t *testing.T) {
+	app, token := newTestApp(t)
+	_, dial := dialHub(t, app, token)
+	sender, other := dial(), dial()
+	waitForTabs(t, "student@example.com", 2)
+
+	// The new chat's title is held up, but the tab's next message still
+	// gets through.
+	if err := sender.WriteJSON(map[string]any{"type": HubSend, "requestId": "r1", "chatId": "new", "question": "hold"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.WriteJSON(map[string]any{"type": HubTyping, "chatId": "new", "typing": true}); err != nil {
+		t.Fatal(err)
+	}
+	if typing := readHub(t, other, HubTyping); typing["typing"] != true {
+		t.Errorf("other tab got %+v", typing)
+	}
+
+	fakeRelease <- struct{}{}
+	if message := readHub(t, sender, HubMessage); message["requestId"] != "r1" {
+		t.Errorf("got %+v, want the held question", message)
+	}
+	readHub(t, sender, EventDone)
+}
+
+func TestHubIdleTabsDontFollow(t *testing.T) {
+	app, token := newTestApp(t)
+	_, dial := dialHub(t, app, token)
+	dial()
+	waitForTabs(t, "student@example.com", 1)
+
+	user, err := users.ByEmail(context.Background(), "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(saved time.Duration) { generationAbandonment = saved }(generationAbandonment)
+	generationAbandonment = time.Millisecond
+
+	// A question whose asker left is stopped even with a tab open
+	// elsewhere.
+	g, _, err := startAsk(user, askRequest{Chat: "new", Question: "wait"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, done, changed := g.after(0)
+		if done {
+			break
+		}
+		<-changed
+	}
+	if events, _, _ := g.after(0); events[len(events)-1].data.(map[string]any)["finishReason"] != FinishStopped {
+		t.Errorf("generation ended with %+v, want it stopped", events[len(events)-1])
+	}
+}
+
+func TestHubRejectsBadSends(t *testing.T) {
+	app, token := newTestApp(t)
+	_, dial := dialHub(t, app, token)
+	ws := dial()
+	waitForTabs(t, "student@example.com", 1)
+
+	err := ws.WriteJSON(map[string]any{"type": HubSend, "requestId": "r2", "chatId": "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejected := readHub(t, ws, HubRejected); rejected["requestId"] != "r2" || rejected["message"] != "empty message" {
+		t.Errorf("got %+v, want the empty message rejected", rejected)
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+
+	_ "image/gif"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// imageMaxDimension downscales uploaded JPEG and PNG images whose longer
+// side is larger, set from IMAGE_MAX_DIMENSION. 0 keeps their size.
+var imageMaxDimension = 0
+
+// maxImagePixels keeps images that would take too much memory to decode from
+// being decoded at all.
+const maxImagePixels = 64 << 20
+
+// thumbnailSize bounds the longer side of thumbnails.
+const thumbnailSize = 256
+
+var errImageTooLarge = errors.New("image is too large")
+
+var errUnsupportedImage = errors.New("unsupported image format")
+
+// normalizeImage prepares an uploaded image for storing: it strips the
+// metadata, which on phone photos includes where they were taken, turns
+// JPEGs upright according to their EXIF orientation, and downscales JPEGs
+// and PNGs larger than maxDimension. Images that need neither turning nor
+// scaling aren't re-encoded, so they lose no quality. BMPs, which have no
+// metadata, are returned unchanged; formats whose metadata can't be
+// stripped, such as HEIC, are refused.
+func normalizeImage(mimeType string, data []byte, maxDimension int) ([]byte, error) {
+	switch mimeType {
+	case "image/jpeg":
+		return normalizeJPEG(data, maxDimension)
+	case "image/png":
+		return normalizePNG(data, maxDimension)
+	case "image/gif":
+		return stripGIFMetadata(data)
+	case "image/webp":
+		return stripWebPMetadata(data)
+	case "image/bmp":
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s images might carry their location, convert them to JPEG or PNG first", errUnsupportedImage, mimeType)
+}
+
+// decodeImage decodes an image after checking that its size is reasonable.
+func decodeImage(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, errImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// tooLarge reports whether an image of a size needs downscaling.
+func tooLarge(size image.Point, maxDimension int) bool {
+	return maxDimension > 0 && (size.X > maxDimension || size.Y > maxDimension)
+}
+
+func normalizeJPEG(data []byte, maxDimension int) ([]byte, error) {
+	stripped, orientation, err := stripJPEGMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(stripped))
+	if err != nil {
+		return nil, err
+	}
+	if orientation <= 1 && !tooLarge(image.Pt(config.Width, config.Height), maxDimension) {
+		return stripped, nil
+	}
+
+	img, err := decodeImage(stripped)
+	if err != nil {
+		return nil, err
+	}
+	img = scaleDown(orient(img, orientation), maxDimension)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func normalizePNG(data []byte, maxDimension int) ([]byte, error) {
+	stripped, err := stripPNGMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := png.DecodeConfig(bytes.NewReader(stripped))
+	if err != nil {
+		return nil, err
+	}
+	if !tooLarge(image.Pt(config.Width, config.Height), maxDimension) {
+		return stripped, nil
+	}
+
+	img, err := decodeImage(stripped)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleDown(img, maxDimension)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// stripJPEGMetadata removes the APPn and comment segments of a JPEG, except
+// for the JFIF header, the ICC color profile and the Adobe segment that
+// decoders need to get colors right, and anything after the end of the
+// image, such as the secondary images of an MPF file. It also returns the
+// EXIF orientation, or 0 if there is none.
+func stripJPEGMetadata(data []byte) ([]byte, int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errors.New("not a JPEG")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	orientation := 0
+
+	for i := 2; ; {
+		if i+2 > len(data) || data[i] != 0xFF {
+			return nil, 0, errors.New("malformed JPEG")
+		}
+		marker := data[i+1]
+
+		// Fill bytes before a marker.
+		if marker == 0xFF {
+			i++
+			continue
+		}
+
+		if marker == 0xD9 {
+			out.Write(data[i : i+2])
+			return out.Bytes(), orientation, nil
+		}
+
+		if i+4 > len(data) {
+			return nil, 0, errors.New("malformed JPEG")
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, 0, errors.New("malformed JPEG")
+		}
+
+		segment := data[i:end]
+		payload := segment[4:]
+		switch {
+		case marker == 0xDA:
+			// The entropy-coded data of a scan follows its header, up to
+			// the next marker other than a restart marker. A file cut
+			// short in a scan is kept as far as it goes.
+			end = entropyCodedEnd(data, end)
+			out.Write(data[i:end])
+			if end == len(data) {
+				return out.Bytes(), orientation, nil
+			}
+		case marker == 0xE1:
+			if o := exifOrientation(payload); o != 0 {
+				orientation = o
+			}
+		case marker == 0xE0 && bytes.HasPrefix(payload, []byte("JFIF\x00")),
+			marker == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")),
+			marker == 0xEE && bytes.HasPrefix(payload, []byte("Adobe")):
+			out.Write(segment)
+		case marker >= 0xE0 && marker <= 0xEF, marker == 0xFE:
+			// Metadata: dropped.
+		default:
+			out.Write(segment)
+		}
+		i = end
+	}
+}
+
+// entropyCodedEnd returns where the entropy-coded data starting at i ends:
+// at the next marker, or the end of data. Within it, 0xFF is only followed
+// by a stuffed 0x00 or a restart marker.
+func entropyCodedEnd(data []byte, i int) int {
+	for ; i+1 < len(data); i++ {
+		if data[i] != 0xFF {
+			continue
+		}
+		next := data[i+1]
+		if next != 0x00 && (next < 0xD0 || next > 0xD7) {
+			return i
+		}
+		i++
+	}
+
+	return len(data)
+}
+
+// exifOrientation reads the orientation tag from the payload of an EXIF
+// APP1 segment, returning 0 if it has none.
+func exifOrientation(payload []byte) int {
+	if !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := payload[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 0
+			}
+			return orientation
+		}
+	}
+
+	return 0
+}
+
+// pngMetadataChunks are the ancillary PNG chunks holding metadata.
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+// stripPNGMetadata removes the text, time and EXIF chunks of a PNG.
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errors.New("not a PNG")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString(signature)
+
+	for i := len(signature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errors.New("malformed PNG")
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errors.New("malformed PNG")
+		}
+
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	return out.Bytes(), nil
+}
+
+// gifKeptApplications are the application extensions of a GIF that aren't
+// metadata: looping, in the two forms browsers understand, and the color
+// profile.
+var gifKeptApplications = map[string]bool{"NETSCAPE2.0": true, "ANIMEXTS1.0": true, "ICCRGBG1012": true}
+
+// stripGIFMetadata removes the comments of a GIF, its application
+// extensions other than those in gifKeptApplications, such as XMP, and
+// anything after its trailer.
+func stripGIFMetadata(data []byte) ([]byte, error) {
+	malformed := errors.New("malformed GIF")
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF87a")) && !bytes.HasPrefix(data, []byte("GIF89a")) {
+		return nil, errors.New("not a GIF")
+	}
+
+	// The header, the logical screen descriptor and the global color
+	// table.
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+	if i > len(data) {
+		return nil, malformed
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:i])
+
+	// subBlocksEnd returns where the data sub-blocks starting at j end,
+	// after their terminator.
+	subBlocksEnd := func(j int) (int, error) {
+		for j < len(data) {
+			size := int(data[j])
+			j += 1 + size
+			if size == 0 {
+				return j, nil
+			}
+		}
+		return 0, malformed
+	}
+
+	for {
+		if i >= len(data) {
+			return nil, malformed
+		}
+
+		start := i
+		switch data[i] {
+		case 0x3B: // trailer
+			out.WriteByte(0x3B)
+			return out.Bytes(), nil
+
+		case 0x2C: // image descriptor, local color table and image data
+			if i+10 > len(data) {
+				return nil, malformed
+			}
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			end, err := subBlocksEnd(i + 1) // after the LZW code size
+			if err != nil {
+				return nil, err
+			}
+			out.Write(data[start:end])
+			i = end
+
+		case 0x21: // extension
+			if i+2 > len(data) {
+				return nil, malformed
+			}
+			label := data[i+1]
+			end, err := subBlocksEnd(i + 2)
+			if err != nil {
+				return nil, err
+			}
+
+			keep := label != 0xFE
+			if label == 0xFF {
+				// The application's identifier and code come in a first
+				// sub-block of 11 bytes.
+				keep = i+14 <= len(data) && data[i+2] == 11 && gifKeptApplications[string(data[i+3:i+14])]
+			}
+			if keep {
+				out.Write(data[start:end])
+			}
+			i = end
+
+		default:
+			return nil, malformed
+		}
+	}
+}
+
+// stripWebPMetadata removes the EXIF and XMP chunks of a WebP, and anything
+// after the RIFF container.
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP")
+	}
+	size := int(binary.LittleEndian.Uint32(data[4:]))
+	if size < 4 || 8+size > len(data) {
+		return nil, errors.New("malformed WebP")
+	}
+	data = data[:8+size]
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errors.New("malformed WebP")
+		}
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + length + length%2
+		if length < 0 || end > len(data) {
+			return nil, errors.New("malformed WebP")
+		}
+
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+			// Metadata: dropped.
+		case "VP8X":
+			// The extended header's flags say which chunks follow.
+			chunk := bytes.Clone(data[i:end])
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+// orient turns an image upright according to its EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-dx, dy
+			case 3: // upside down
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // mirrored upside down
+				sx, sy = dx, h-1-dy
+			case 5: // mirrored, on its side
+				sx, sy = dy, dx
+			case 6: // needs turning clockwise
+				sx, sy = dy, h-1-dx
+			case 7: // mirrored, on its other side
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // needs turning counterclockwise
+				sx, sy = w-1-dy, dx
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(sx, sy):][:4])
+		}
+	}
+
+	return dst
+}
+
+// scaleDown shrinks an image so that its longer side is at most
+// maxDimension, keeping its aspect ratio. 0 leaves the image as it is.
+func scaleDown(img image.Image, maxDimension int) image.Image {
+	b := img.Bounds()
+	if !tooLarge(b.Size(), maxDimension) {
+		return img
+	}
+
+	w, h := maxDimension, b.Dy()*maxDimension/b.Dx()
+	if b.Dy() > b.Dx() {
+		w, h = b.Dx()*maxDimension/b.Dy(), maxDimension
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, max(w, 1), max(h, 1)))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+
+	return dst
+}
+
+// makeThumbnail returns a JPEG thumbnail of an image, with any transparency
+// on white.
+func makeThumbnail(data []byte) ([]byte, error) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("thumbnail: %w", err)
+	}
+	img = scaleDown(img, thumbnailSize)
+
+	b := img.Bounds()
+	thumbnail := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(thumbnail, thumbnail.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(thumbnail, thumbnail.Bounds(), img, b.Min, draw.Over)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
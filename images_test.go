@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/image/webp"
+)
+
+// halves returns a 32x16 image, red on the left and blue on the right.
+func halves() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 16 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// withEXIF inserts an EXIF segment with an orientation and a location-like
+// string right after a JPEG's start of image marker.
+func withEXIF(data []byte, orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	binary.Write(&tiff, binary.BigEndian, uint16(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{0x0112, 3})
+	binary.Write(&tiff, binary.BigEndian, uint32(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{orientation, 0})
+	binary.Write(&tiff, binary.BigEndian, uint32(0))
+	tiff.WriteString("GPS 48.8584N 2.2945E")
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r > 0xC000 && g < 0x4000 && b < 0x4000
+}
+
+func TestNormalizeJPEG(t *testing.T) {
+	plain := encodeJPEG(t, halves())
+
+	// Upright images only lose their metadata.
+	got, err := normalizeImage("image/jpeg", withEXIF(plain, 1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("stripping the EXIF segment of an upright JPEG changed its image data")
+	}
+
+	// Orientation 6 needs turning clockwise, which puts the red half on
+	// top.
+	got, err = normalizeImage("image/jpeg", withEXIF(plain, 6), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(got, []byte("Exif")) || bytes.Contains(got, []byte("GPS")) {
+		t.Error("normalized JPEG still has its EXIF data")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(16, 32) {
+		t.Fatalf("turned image is %v, want 16x32", size)
+	}
+	if !isRed(img.At(8, 4)) || isRed(img.At(8, 28)) {
+		t.Error("image wasn't turned clockwise")
+	}
+
+	got, err = normalizeImage("image/jpeg", withEXIF(plain, 1), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 8 || config.Height != 4 {
+		t.Errorf("downscaled image is %dx%d, want 8x4", config.Width, config.Height)
+	}
+}
+
+func TestNormalizePNG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, halves()); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	// A tEXt chunk right after the header.
+	text := []byte("tEXtLocation\x00Lab 3")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)-4))
+	chunk = append(chunk, text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(text))
+	const headerEnd = 8 + 25
+	tagged := append(append(append([]byte{}, plain[:headerEnd]...), chunk...), plain[headerEnd:]...)
+
+	got, err := normalizeImage("image/png", tagged, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("normalizing a PNG didn't just remove its text chunk")
+	}
+
+	got, err = normalizeImage("image/png", tagged, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 8 || config.Height != 4 {
+		t.Errorf("downscaled image is %dx%d, want 8x4", config.Width, config.Height)
+	}
+}
+
+func TestUploadNormalizesImages(t *testing.T) {
+	app, token := newTestApp(t)
+	ctx := context.Background()
+
+	config := filepath.Join(t.TempDir(), "models.json")
+	err := os.WriteFile(config, []byte(`{
+		"default": "fake",
+		"summarizer": "fake",
+		"models": [{"id": "fake", "name": "Fake", "backend": "fake", "multimodal": true, "enabled": true}]
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registry, err = loadModelRegistry(config, map[string]Provider{"fake": &fakeProvider{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	photo := withEXIF(encodeJPEG(t, image.NewRGBA(image.Rect(0, 0, 600, 300))), 6)
+	status, result := uploadFile(t, app, token, "photo.jpg", "image/jpeg", string(photo))
+	if status != fiber.StatusOK {
+		t.Fatalf("uploading a photo got %d %v", status, result)
+	}
+
+	id, _ := ObjectIDFromHex(result["id"].(string))
+	file, err := uploads.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := readBlob(ctx, file.Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("GPS")) || file.Size != int64(len(stored)) {
+		t.Errorf("stored photo has its EXIF data or the wrong size %d", file.Size)
+	}
+
+	if result["thumbnail"] != "/api/files/"+file.ID.Hex()+"/thumbnail" || file.Thumbnail == "" {
+		t.Fatalf("upload response %v and file %+v have no thumbnail", result, file)
+	}
+	if refs, _ := uploads.BlobRefs(ctx); refs[file.Thumbnail] != 1 {
+		t.Error("thumbnail isn't referenced, so the garbage collector would delete it")
+	}
+
+	req := httptest.NewRequest("GET", result["thumbnail"].(string), nil)
+	req.Header.Set("Cookie", "token="+token)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	thumbnail, err := jpeg.DecodeConfig(bytes.NewReader(body))
+	if resp.StatusCode != fiber.StatusOK || err != nil {
+		t.Fatalf("thumbnail got %d: %v", resp.StatusCode, err)
+	}
+	if thumbnail.Width != 128 || thumbnail.Height != 256 {
+		t.Errorf("thumbnail is %dx%d, want the turned photo at 128x256", thumbnail.Width, thumbnail.Height)
+	}
+}
+
+// appSegment returns a JPEG APPn segment with a payload.
+func appSegment(marker byte, payload string) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func TestNormalizeJPEGDropsMPF(t *testing.T) {
+	plain := encodeJPEG(t, halves())
+
+	// A camera's MPF file: the primary image with its color profile and
+	// the index of the secondary images, which follow it with their own
+	// EXIF data.
+	icc := appSegment(0xE2, "ICC_PROFILE\x00\x01\x01profile")
+	mpf := appSegment(0xE2, "MPF\x00II*\x00\x08\x00\x00\x00")
+	var photo []byte
+	photo = append(photo, plain[:2]...)
+	photo = append(photo, icc...)
+	photo = append(photo, mpf...)
+	photo = append(photo, withEXIF(plain, 1)[2:]...)
+	photo = append(photo, withEXIF(plain, 1)...)
+
+	got, err := normalizeImage("image/jpeg", photo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(append([]byte{}, plain[:2]...), icc...), plain[2:]...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("normalized MPF file has %d bytes, want the %d of the primary image with only its color profile", len(got), len(want))
+	}
+	if bytes.Contains(got, []byte("GPS")) || bytes.Contains(got, []byte("MPF")) {
+		t.Error("normalized JPEG still has metadata")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(got)); err != nil {
+		t.Errorf("normalized JPEG doesn't decode: %v", err)
+	}
+}
+
+func TestNormalizeGIF(t *testing.T) {
+	frame := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &gif.GIF{
+		Image:  []*image.Paletted{frame, frame},
+		Delay:  []int{10, 10},
+		Config: image.Config{ColorModel: frame.Palette, Width: 4, Height: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	// A comment and an XMP packet after the global color table, and data
+	// after the trailer. The encoder's own looping extension stays.
+	comment := append([]byte{0x21, 0xFE, 15}, "GPS 48.8584N 2E"...)
+	comment = append(comment, 0)
+	xmp := append([]byte{0x21, 0xFF, 11}, "XMP DataXMP"...)
+	xmp = append(xmp, 8)
+	xmp = append(xmp, "<x:xmpm>"...)
+	xmp = append(xmp, 0)
+	const headerEnd = 13 + 3*2
+	var tagged []byte
+	tagged = append(tagged, plain[:headerEnd]...)
+	tagged = append(tagged, comment...)
+	tagged = append(tagged, xmp...)
+	tagged = append(tagged, plain[headerEnd:]...)
+	tagged = append(tagged, "trailing GPS"...)
+
+	got, err := normalizeImage("image/gif", tagged, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("normalized GIF is\n%q\nwant\n%q", got, plain)
+	}
+	if decoded, err := gif.DecodeAll(bytes.NewReader(got)); err != nil || len(decoded.Image) != 2 {
+		t.Errorf("normalized GIF doesn't decode to both frames: %v", err)
+	}
+}
+
+// tinyWebP is a 1x1 lossless WebP: its VP8L chunk after the RIFF header.
+var tinyWebP = []byte("RIFF\x1a\x00\x00\x00WEBPVP8L\x0e\x00\x00\x00\x2f\x00\x00\x00\x10\x07\x10\x11\x11\x88\x88\x08\xfe\x07")
+
+// riffChunk returns a RIFF chunk, padded to an even length.
+func riffChunk(fourCC, data string) []byte {
+	chunk := binary.LittleEndian.AppendUint32([]byte(fourCC), uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func TestNormalizeWebP(t *testing.T) {
+	// The extended format, with EXIF and XMP flagged in its header, and
+	// data after the RIFF container.
+	header := riffChunk("VP8X", "\x0c\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	var body []byte
+	body = append(body, "WEBP"...)
+	body = append(body, header...)
+	body = append(body, tinyWebP[12:]...)
+	body = append(body, riffChunk("EXIF", "MM\x00\x2aGPS 48.8584N 2.2945E")...)
+	body = append(body, riffChunk("XMP ", "<x:xmpmeta/>")...)
+	tagged := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+	tagged = append(tagged, body...)
+	tagged = append(tagged, "trailing GPS"...)
+
+	got, err := normalizeImage("image/webp", tagged, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(got, []byte("GPS")) || bytes.Contains(got, []byte("xmp")) {
+		t.Errorf("normalized WebP still has metadata: %q", got)
+	}
+	if size := binary.LittleEndian.Uint32(got[4:]); int(size) != len(got)-8 {
+		t.Errorf("RIFF size is %d, want %d", size, len(got)-8)
+	}
+	if flags := got[20]; flags != 0 {
+		t.Errorf("extended header flags are %#x, want EXIF and XMP cleared", flags)
+	}
+	if img, err := webp.Decode(bytes.NewReader(got)); err != nil || img.Bounds().Size() != image.Pt(1, 1) {
+		t.Errorf("normalized WebP doesn't decode: %v", err)
+	}
+
+	// Simple WebPs have nowhere to keep metadata.
+	if got, err := normalizeImage("image/webp", tinyWebP, 0); err != nil || !bytes.Equal(got, tinyWebP) {
+		t.Errorf("normalizing a simple WebP got %q, %v", got, err)
+	}
+}
+
+func TestNormalizeRefusesHEIC(t *testing.T) {
+	// The start of an iPhone photo's ftyp box.
+	heic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+	if _, err := normalizeImage("image/heic", heic, 0); !errors.Is(err, errUnsupportedImage) {
+		t.Errorf("got %v, want HEIC refused", err)
+	}
+
+	app, token := newTestApp(t)
+	config := filepath.Join(t.TempDir(), "models.json")
+	err := os.WriteFile(config, []byte(`{
+		"default": "fake",
+		"summarizer": "fake",
+		"models": [{"id": "fake", "name": "Fake", "backend": "fake", "multimodal": true, "enabled": true}]
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registry, err = loadModelRegistry(config, map[string]Provider{"fake": &fakeProvider{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	status, result := uploadFile(t, app, token, "IMG_0001.HEIC", "image/heic", string(heic))
+	if status != fiber.StatusUnsupportedMediaType || !strings.Contains(result["error"].(string), "convert them to JPEG or PNG") {
+		t.Errorf("uploading a HEIC photo got %d %v", status, result)
+	}
+}
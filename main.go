@@ -2,28 +2,26 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"crypto/sha256"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"mime"
 	"os"
-	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
 
-	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
-
+	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/template/html/v2"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -41,13 +39,31 @@ var MAILJET_PRIVATE string
 var MAILJET_PUBLIC string
 var EMAIL_SENDER string
 var TIMEZONE string
+var OPENAI_BASE_URL string
+var OPENAI_API_KEY string
+var OLLAMA_URL string
+var MODELS_CONFIG string
+var UPLOAD_STORAGE string
+var UPLOAD_DIR string
+var S3_ENDPOINT string
+var S3_BUCKET string
+var S3_ACCESS_KEY string
+var S3_SECRET_KEY string
+var S3_REGION string
+var S3_INSECURE string
+var UPLOAD_MAX_FILE_MB string
+var UPLOAD_USER_QUOTA_MB string
+var UPLOAD_GROUP_QUOTA_MB string
+var IMAGE_MAX_DIMENSION string
 var ctx = context.TODO()
-var users *mongo.Collection
-var emailVerification *mongo.Collection
-var chats *mongo.Collection
-var uploads *mongo.Collection
+var users UserStore
+var emailVerification VerificationStore
+var chats ChatStore
+var uploads FileStore
 var database *mongo.Database
 var mailjetClient *mailjet.Client
+var registry *ModelRegistry
+var blobs BlobStore
 
 type TokenInfo struct {
 	Email string
@@ -57,44 +73,43 @@ type TokenInfo struct {
 
 type User struct {
 	ID            primitive.ObjectID `bson:"_id"`
-	StudentID     string
-	Email         string
-	Name          string
-	JTI           []string
-	EmailVerified bool
+	StudentID     string             `bson:"studentID"`
+	Email         string             `bson:"email"`
+	Name          string             `bson:"name"`
+	JTI           []string           `bson:"jtis"`
+	EmailVerified bool               `bson:"emailVerified"`
+	Group         string             `bson:"group"` // shares a storage quota with the group's other users; empty for none
 }
 
 type Verification struct {
-	ID    primitive.ObjectID `bson:"_id"`
-	Email string
-	Code  string
+	ID        primitive.ObjectID `bson:"_id"`
+	Email     string             `bson:"email"`
+	Code      string             `bson:"code"`
+	CreatedAt time.Time          `bson:"createdAt"`
 }
 
 type Chat struct {
-	ID      primitive.ObjectID `bson:"_id"`
-	User    primitive.ObjectID `bson:"user"`
-	Title   string             `bson:"title"`
-	History []interface{}      `bson:"history"`
-	Model   string             `bson:"model"`
-}
-
-type ContentChat struct {
-	ID      primitive.ObjectID `bson:"_id"`
-	User    primitive.ObjectID `bson:"user"`
-	History []Content          `bson:"history"`
-	Model   string             `bson:"model"`
+	ID            primitive.ObjectID `bson:"_id"`
+	User          primitive.ObjectID `bson:"user"`
+	Title         string             `bson:"title"`
+	Messages      []Message          `bson:"messages"` // every branch's, each after its parent, see branches.go
+	Leaf          primitive.ObjectID `bson:"leaf"`     // last message of the branch shown
+	Model         string             `bson:"model"`    // where questions go unless they say otherwise; replies record their own
+	SchemaVersion int                `bson:"schemaVersion"`
 }
 
 type File struct {
-	ID   primitive.ObjectID `bson:"_id"`
-	User primitive.ObjectID `bson:"user"`
-	Name string             `bson:"name"`
-	Path string             `bson:"path"`
-}
-
-type Content struct {
-	Parts []string
-	Role  string
+	ID       primitive.ObjectID `bson:"_id"`
+	User     primitive.ObjectID `bson:"user"`
+	Name     string             `bson:"name"`
+	Path     string             `bson:"path"`
+	MIMEType string             `bson:"mimeType"`
+	Size     int64              `bson:"size"`
+	Group    string             `bson:"group"`          // the uploader's group at upload time, counted against its quota
+	Text     string             `bson:"text,omitempty"` // extracted from documents models can't read natively, see extractText
+	Blob     string             `bson:"blob"`           // blobs key; empty for files uploaded before the blob store, which use Path
+
+	Thumbnail string `bson:"thumbnail,omitempty"` // blobs key of a JPEG thumbnail, for images
 }
 
 var (
@@ -111,31 +126,104 @@ func main() {
 	MAILJET_PUBLIC = os.Getenv("MAILJET_PUBLIC")
 	EMAIL_SENDER = os.Getenv("EMAIL_SENDER")
 	TIMEZONE = os.Getenv("TIMEZONE")
+	OPENAI_BASE_URL = os.Getenv("OPENAI_BASE_URL")
+	OPENAI_API_KEY = os.Getenv("OPENAI_API_KEY")
+	OLLAMA_URL = os.Getenv("OLLAMA_URL")
+	MODELS_CONFIG = os.Getenv("MODELS_CONFIG")
+	if MODELS_CONFIG == "" {
+		MODELS_CONFIG = "models.json"
+	}
+	UPLOAD_STORAGE = os.Getenv("UPLOAD_STORAGE")
+	UPLOAD_DIR = os.Getenv("UPLOAD_DIR")
+	if UPLOAD_DIR == "" {
+		UPLOAD_DIR = "./uploads"
+	}
+	S3_ENDPOINT = os.Getenv("S3_ENDPOINT")
+	S3_BUCKET = os.Getenv("S3_BUCKET")
+	S3_ACCESS_KEY = os.Getenv("S3_ACCESS_KEY")
+	S3_SECRET_KEY = os.Getenv("S3_SECRET_KEY")
+	S3_REGION = os.Getenv("S3_REGION")
+	S3_INSECURE = os.Getenv("S3_INSECURE")
+	UPLOAD_MAX_FILE_MB = os.Getenv("UPLOAD_MAX_FILE_MB")
+	UPLOAD_USER_QUOTA_MB = os.Getenv("UPLOAD_USER_QUOTA_MB")
+	UPLOAD_GROUP_QUOTA_MB = os.Getenv("UPLOAD_GROUP_QUOTA_MB")
+	IMAGE_MAX_DIMENSION = os.Getenv("IMAGE_MAX_DIMENSION")
+
+	var err error
+	if limits.MaxFileSize, err = parseMegabytes("UPLOAD_MAX_FILE_MB", UPLOAD_MAX_FILE_MB, limits.MaxFileSize); err != nil {
+		log.Fatal(err)
+	}
+	if limits.UserQuota, err = parseMegabytes("UPLOAD_USER_QUOTA_MB", UPLOAD_USER_QUOTA_MB, limits.UserQuota); err != nil {
+		log.Fatal(err)
+	}
+	if limits.GroupQuota, err = parseMegabytes("UPLOAD_GROUP_QUOTA_MB", UPLOAD_GROUP_QUOTA_MB, limits.GroupQuota); err != nil {
+		log.Fatal(err)
+	}
+	if IMAGE_MAX_DIMENSION != "" {
+		if imageMaxDimension, err = strconv.Atoi(IMAGE_MAX_DIMENSION); err != nil || imageMaxDimension < 0 {
+			log.Fatalf("IMAGE_MAX_DIMENSION: %q is not a size in pixels", IMAGE_MAX_DIMENSION)
+		}
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		connect()
+		connectBlobStore()
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		connect()
+		connectBlobStore()
+		if err := runGC(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	mailjetClient = mailjet.NewMailjetClient(MAILJET_PUBLIC, MAILJET_PRIVATE)
 
 	ctx := context.Background()
-	client, err := genai.NewClient(ctx, option.WithAPIKey(GEMINI_API_KEY))
+	gemini, err := newGeminiProvider(ctx, GEMINI_API_KEY)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer gemini.Close()
+
+	providers := map[string]Provider{"gemini": gemini}
+	if OPENAI_BASE_URL != "" {
+		providers["openai"] = newOpenAIProvider(OPENAI_BASE_URL, OPENAI_API_KEY)
+	}
+	if OLLAMA_URL != "" {
+		providers["ollama"] = newOllamaProvider(OLLAMA_URL)
+	}
+
+	registry, err = loadModelRegistry(MODELS_CONFIG, providers)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer client.Close()
 
-	var models = make(map[string]*genai.GenerativeModel)
+	app := newApp()
 
-	models["gemini-1.5-flash-8b"] = client.GenerativeModel("gemini-1.5-flash-8b")
-	models["gemini-1.5-flash"] = client.GenerativeModel("gemini-1.5-flash")
-	models["gemini-2.0-flash-exp"] = client.GenerativeModel("gemini-2.0-flash-exp")
-	models["summarize"] = client.GenerativeModel("gemini-1.5-flash-8b")
+	connect()
+	connectBlobStore()
 
-	models["summarize"].SystemInstruction = &genai.Content{
-		Parts: []genai.Part{
-			genai.Text(
-				"You are a title generator for conversations between humans. Create concise, engaging, and relevant titles based on the provided conversation content. Do not provide titles in Markdown. Do not return multiple responses. Do not provide anything related to that it is a conversation. Do not answer or reply to the initial statement.",
-			),
-		},
+	pending, err := migrations.Pending(ctx)
+	if err != nil {
+		log.Fatal(err)
 	}
+	if len(pending) > 0 {
+		log.Printf("%d database migrations are pending, run \"geminui migrate up\" to apply them", len(pending))
+	}
+
+	go runGarbageCollector(ctx, blobGCInterval)
 
+	log.Fatal(app.Listen(":3000"))
+}
+
+func newApp() *fiber.App {
 	engine := html.New("./templates", ".html")
 	engine.AddFunc("idtostring", func(id primitive.ObjectID) string { return id.Hex() })
 	engine.AddFunc("mdtohtml", markdownToHTML)
@@ -143,8 +231,19 @@ func main() {
 		return template.HTML(html)
 	})
 	engine.AddFunc("replace", replace)
+	engine.AddFunc("dataurl", dataURL)
+	engine.AddFunc("json", toJSON)
+	engine.AddFunc("filesize", formatSize)
+	engine.AddFunc("hasprefix", strings.HasPrefix)
+	engine.AddFunc("modelname", func(id string) string { return registry.Name(id) })
 	engine.Reload(true)
-	app := fiber.New(fiber.Config{Views: engine})
+	// Leave room for the rest of the multipart form, so that uploads just
+	// over the limit get the upload handler's JSON error instead of fiber's.
+	bodyLimit := fiber.DefaultBodyLimit
+	if limit := int(limits.MaxFileSize) + 1<<20; limit > bodyLimit {
+		bodyLimit = limit
+	}
+	app := fiber.New(fiber.Config{Views: engine, BodyLimit: bodyLimit})
 	app.Static("/static", "./static")
 	app.Use(logger.New(logger.Config{
 		Format:     "${time} - ${status} - ${ip} ${method} ${path}\n",
@@ -165,25 +264,17 @@ func main() {
 				return c.Redirect("/login", 302)
 			}
 
-			var user User
-			err = users.FindOne(context.TODO(), bson.M{"_id": parsedToken.ID}).Decode(&user)
+			user, err := users.ByID(ctx, parsedToken.ID)
 			if err != nil {
 				return c.Status(fiber.StatusNotFound).SendString("error: an unknown error occured")
 			}
 
-			cursor, err := chats.Find(ctx, bson.M{"user": user.ID})
+			chatList, err := chats.ListByUser(ctx, user.ID)
 			if err != nil {
 				return fiber.ErrNotFound
 			}
 
-			var chatList []Chat
-			if err = cursor.All(ctx, &chatList); err != nil {
-				// idk
-			}
-
-			chatList = reverse(chatList)
-
-			return c.Render("index", fiber.Map{"Chats": chatList, "User": user})
+			return c.Render("index", fiber.Map{"Chats": chatList, "User": user, "Models": registry.Enabled(), "DefaultModel": registry.Default})
 		}
 	})
 
@@ -194,12 +285,26 @@ func main() {
 	app.Get("/verify/:id", handleVerificationPage)
 	app.Post("/verify/:id", handleVerification)
 
+	app.Get("/files", handleFilesPage)
+	app.Get("/api/files", handleListFiles)
+	app.Patch("/api/files/:id", handleRenameFile)
+	app.Delete("/api/files/:id", handleDeleteFile)
+	app.Post("/api/files/delete", handleDeleteFiles)
+
+	app.Patch("/api/chats/:id", handleRenameChat)
+	app.Post("/api/chats/:id/messages/:message/edit", handleEditMessage)
+	app.Post("/api/chats/:id/messages/:message/regenerate", handleRegenerate)
+	app.Post("/api/chats/:id/messages/:message/select", handleSelectBranch)
+	app.Post("/api/chats/:id/messages/:message/fork", handleForkChat)
+	app.Get("/api/chats/:id/warning", handleModelWarning)
+
+	app.Use("/api/ws", handleHubUpgrade)
+	app.Get("/api/ws", websocket.New(handleHub))
+
 	app.Post("/api/ask", func(c *fiber.Ctx) error {
 		token := c.Cookies("token", "")
-		question := c.FormValue("question")
-		chosenModel := c.FormValue("model", "gemini-1.5-flash")
-		id := c.Query("chat", "new")
 
+		var err error
 		var parsedToken *TokenInfo
 
 		if token == "" {
@@ -213,130 +318,93 @@ func main() {
 			}
 		}
 
-		var user User
-		err := users.FindOne(context.TODO(), bson.M{"email": parsedToken.Email}).Decode(&user)
+		user, err := users.ByEmail(ctx, parsedToken.Email)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).SendString("error: an unknown error occured")
 		}
 
-		var chat ContentChat
-
-		if id != "new" {
-			objID, err := ObjectIDFromHex(id)
-			if err != nil {
-				return c.Status(fiber.StatusNotFound).SendString("error: an unknown error occured")
-			}
-
-			result := chats.FindOne(ctx, bson.D{{Key: "_id", Value: objID}})
-			if result.Err() == mongo.ErrNoDocuments {
-				return c.Status(fiber.StatusNotFound).SendString("error: not found")
-			}
-
-			err = chats.FindOne(ctx, bson.D{{Key: "_id", Value: objID}}).Decode(&chat)
-			if err != nil {
-				return c.Status(fiber.StatusInternalServerError).
-					SendString("error: an unknown error occured")
-			}
-
-			if chat.User != user.ID {
-				return c.Status(fiber.StatusForbidden).SendString("error: forbidden")
-			}
+		return streamAsk(c, user, askRequest{
+			Chat:      c.Query("chat", "new"),
+			Question:  c.FormValue("question"),
+			Model:     c.FormValue("model"),
+			Files:     formValues(c, "files"),
+			RequestID: c.FormValue("requestId"),
+		})
+	})
 
-			chosenModel = chat.Model
+	// Clients that lost the connection to a generation resume it here, with
+	// the ID of the last event they got in Last-Event-ID.
+	app.Get("/api/ask/:id/events", func(c *fiber.Ctx) error {
+		token := c.Cookies("token", "")
+		if token == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
 		}
 
-		if !slices.Contains(
-			[]string{"gemini-1.5-flash", "gemini-1.5-flash-8b", "gemini-2.0-flash-exp"},
-			chosenModel,
-		) {
-			return c.Status(fiber.StatusForbidden).SendString("error: invalid model")
+		parsedToken, err := parseJWT(token)
+		if err != nil {
+			c.ClearCookie(token)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
 		}
 
-		model := models[chosenModel]
-
-		loc, _ := time.LoadLocation(TIMEZONE)
-		now := time.Now().In(loc)
-
-		model.SystemInstruction = &genai.Content{
-			Parts: []genai.Part{
-				genai.Text(
-					"The current time is " + now.Format(time.Kitchen) + " on " + now.Format(time.DateOnly) + ".",
-				),
-			},
+		user, err := users.ByEmail(ctx, parsedToken.Email)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
 		}
 
-		cs := model.StartChat()
-		var title string
-
-		if id != "new" {
-			cs.History = convertToGenaiContent(chat.History)
-		} else {
-			response, err := models["summarize"].GenerateContent(ctx, genai.Text("Write a max 5 word title for an AI chat with this as the first question: "+question))
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			title = strings.TrimSpace(fmt.Sprintf("%v", response.Candidates[0].Content.Parts[0]))
+		// Generations are forgotten a while after they finish; by then the
+		// answer is in the chat.
+		objID, err := ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "no such generation"})
 		}
-
-		answer := cs.SendMessageStream(ctx, genai.Text(question))
+		g, ok := generations.get(objID, user.ID)
+		if !ok {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "no such generation"})
+		}
+		last, _ := strconv.Atoi(c.Get("Last-Event-ID"))
 
 		c.Set("Content-Type", "text/event-stream")
 		c.Set("Cache-Control", "no-cache")
 		c.Set("Connection", "keep-alive")
 
 		c.Response().SetBodyStreamWriter(func(w *bufio.Writer) {
-			for {
-				resp, err := answer.Next()
-				if err == iterator.Done {
-					if id == "new" {
-						_, err := chats.InsertOne(ctx, Chat{
-							ID:      primitive.NewObjectID(),
-							User:    user.ID,
-							Title:   title,
-							History: convertToInterface(cs.History),
-							Model:   chosenModel,
-						})
-						if err != nil {
-							log.Fatal(err)
-						}
-					} else {
-						_, err := chats.UpdateOne(
-							ctx,
-							bson.M{"_id": chat.ID},
-							bson.M{"$set": bson.M{"history": cs.History}},
-						)
-						if err != nil {
-							log.Fatal(err)
-						}
-					}
-
-					return
-				}
-				if err != nil {
-					w.Write([]byte("Error: an error occured: " + err.Error()))
-					return
-				}
-
-				data := []byte(fmt.Sprintf("%s", resp.Candidates[0].Content.Parts[0]))
-				if _, err := w.Write(data); err != nil {
-					log.Printf("Error writing to stream: %v", err)
-					return
-				}
-				err = w.Flush()
-				if err != nil {
-					log.Printf("Error flushing stream: %v", err)
-					return
-				}
-			}
+			(&eventStream{w: w}).follow(g, last)
 		})
 
 		return nil
 	})
 
+	app.Post("/api/ask/:id/cancel", func(c *fiber.Ctx) error {
+		token := c.Cookies("token", "")
+		if token == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+
+		parsedToken, err := parseJWT(token)
+		if err != nil {
+			c.ClearCookie(token)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+
+		user, err := users.ByEmail(ctx, parsedToken.Email)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+
+		// Other users' generations are reported as not running, like the
+		// ones that have already finished.
+		objID, err := ObjectIDFromHex(c.Params("id"))
+		if err != nil || !generations.stop(objID, user.ID) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "no such generation is running"})
+		}
+
+		return c.JSON(fiber.Map{"ok": "generation stopped"})
+	})
+
 	app.Get("/api/newest", func(c *fiber.Ctx) error {
 		token := c.Cookies("token", "")
 
+		var err error
 		var parsedToken *TokenInfo
 
 		if token == "" {
@@ -350,79 +418,291 @@ func main() {
 			}
 		}
 
-		var user User
-		if err = users.FindOne(ctx, bson.M{"email": parsedToken.Email}).Decode(&user); err != nil {
+		user, err := users.ByEmail(ctx, parsedToken.Email)
+		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
 		}
 
-		var chat Chat
-		if err = chats.FindOne(ctx, bson.M{"user": user.ID}, options.FindOne().SetSort(bson.M{"$natural": -1})).Decode(&chat); err != nil {
+		chat, err := chats.Newest(ctx, user.ID)
+		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "none found"})
 		}
 
 		return c.JSON(chat)
 	})
 
+	app.Get("/api/quota", func(c *fiber.Ctx) error {
+		token := c.Cookies("token", "")
+		if token == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+
+		parsedToken, err := parseJWT(token)
+		if err != nil {
+			c.ClearCookie(token)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+
+		user, err := users.ByEmail(ctx, parsedToken.Email)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+
+		status, err := quotaStatus(ctx, user)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured"})
+		}
+
+		return c.JSON(status)
+	})
+
 	app.Post("/api/upload", func(c *fiber.Ctx) error {
+		token := c.Cookies("token", "")
+		if token == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+
+		parsedToken, err := parseJWT(token)
+		if err != nil {
+			c.ClearCookie(token)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+
+		user, err := users.ByEmail(ctx, parsedToken.Email)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+
 		file, err := c.FormFile("file")
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "no file provided"})
 		}
 
-		token := c.Cookies("token", "")
-		var parsedToken *TokenInfo
+		if file.Size > limits.MaxFileSize {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error": fmt.Sprintf("%s is %s, larger than the %s limit", file.Filename, formatSize(file.Size), formatSize(limits.MaxFileSize)),
+			})
+		}
 
-		if token == "" {
-			return c.Status(fiber.StatusUnauthorized).SendString("error: unauthorized")
+		f, err := file.Open()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an error occured while trying to save the file"})
+		}
+		defer f.Close()
+
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		head = head[:n]
+
+		// Check the file against the model it's for, or else any model.
+		// Models that can't read a document natively are sent its text.
+		mimeType := detectMIMEType(head, file.Header.Get("Content-Type"), file.Filename)
+		accepted := registry.Accepts(mimeType)
+		config, _, ok := registry.Get(c.FormValue("model"))
+		if ok {
+			accepted = config.Accepts(mimeType)
 		} else {
-			parsedToken, err = parseJWT(token)
+			config, _ = registry.Config(registry.Default)
+		}
+		if !accepted && !isDocumentMIMEType(mimeType) {
+			return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+				"error": fmt.Sprintf("%s is %s, which can't be sent to the model", file.Filename, mimeType),
+			})
+		}
 
-			if err != nil {
-				c.ClearCookie(token)
-				return c.Status(fiber.StatusUnauthorized).SendString("error: unauthorized")
+		// Images are stored without their metadata, and small enough for
+		// the model if IMAGE_MAX_DIMENSION is set. They're read whole,
+		// which the size limit above keeps reasonable.
+		var body io.Reader = io.MultiReader(bytes.NewReader(head), f)
+		var imageData []byte
+		if strings.HasPrefix(mimeType, "image/") {
+			if imageData, err = io.ReadAll(body); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an error occured while trying to save the file"})
+			}
+			if imageData, err = normalizeImage(mimeType, imageData, imageMaxDimension); err != nil {
+				return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+					"error": fmt.Sprintf("couldn't read the image %s: %v", file.Filename, err),
+				})
 			}
+			body = bytes.NewReader(imageData)
 		}
 
-		var user User
-		err = users.FindOne(context.TODO(), bson.M{"email": parsedToken.Email}).Decode(&user)
+		key, size, err := blobs.Put(ctx, body)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).SendString("error: an unknown error occured")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an error occured while trying to save the file"})
 		}
 
-		var filename string
+		// Uploading the same contents again reuses the user's existing file,
+		// which takes no more of their quota. A new blob that doesn't fit is
+		// left for the garbage collector. The quota is checked here so that
+		// nothing is extracted from files that won't fit, and again when the
+		// upload is recorded, in case others were recorded in between.
+		upload, err := uploads.ByBlob(ctx, user.ID, key)
+		var quotaErr *QuotaError
+		if err == ErrNotFound {
+			if err := checkQuota(ctx, user, size); errors.As(err, &quotaErr) {
+				return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": quotaErr.Error()})
+			} else if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured"})
+			}
 
-		f, err := file.Open()
+			// Documents get their text extracted even for models that read
+			// them natively, in case the chat later switches to one that
+			// doesn't.
+			var text string
+			if isDocumentMIMEType(mimeType) {
+				data, err := readBlob(ctx, key)
+				if err != nil {
+					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an error occured while trying to save the file"})
+				}
+				if text, err = extractText(mimeType, data); err != nil && !accepted {
+					return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+						"error": fmt.Sprintf("couldn't read the text of %s: %v", file.Filename, err),
+					})
+				}
+			}
+
+			// Formats that can't be decoded, like BMP, go without a
+			// thumbnail.
+			var thumbnail string
+			if imageData != nil {
+				if data, err := makeThumbnail(imageData); err != nil {
+					log.Printf("%s: %v", file.Filename, err)
+				} else if thumbnail, _, err = blobs.Put(ctx, bytes.NewReader(data)); err != nil {
+					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an error occured while trying to save the file"})
+				}
+			}
+
+			upload = &File{
+				User:      user.ID,
+				Name:      file.Filename,
+				MIMEType:  mimeType,
+				Size:      size,
+				Blob:      key,
+				Group:     user.Group,
+				Text:      text,
+				Thumbnail: thumbnail,
+			}
+			err = createWithinQuota(ctx, user, upload)
+		} else if err == nil && isDocumentMIMEType(upload.MIMEType) {
+			upload, err = uploads.Get(ctx, upload.ID)
+		}
+		if errors.As(err, &quotaErr) {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": quotaErr.Error()})
+		}
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an error occured while trying to save the file"})
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an unknown error occured"})
 		}
 
-		h := sha256.New()
-		if _, err := io.Copy(h, f); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "an error occured while trying to save the file"})
+		response := fiber.Map{
+			"ok":       "file uploaded successfully",
+			"id":       upload.ID.Hex(),
+			"name":     upload.Name,
+			"mimeType": upload.MIMEType,
+			"size":     upload.Size,
+		}
+		if upload.Thumbnail != "" {
+			response["thumbnail"] = "/api/files/" + upload.ID.Hex() + "/thumbnail"
+		}
+		if warning := uploadContextWarning(config, upload); warning != "" {
+			response["warning"] = warning
 		}
+		return c.JSON(response)
+	})
 
-		filename = string(h.Sum(nil))
+	app.Get("/api/files/:id/thumbnail", func(c *fiber.Ctx) error {
+		token := c.Cookies("token", "")
+		if token == "" {
+			return c.Status(fiber.StatusUnauthorized).SendString("error: unauthorized")
+		}
 
-		c.SaveFile(file, "./uploads/" + filename)
+		parsedToken, err := parseJWT(token)
+		if err != nil {
+			c.ClearCookie(token)
+			return c.Status(fiber.StatusUnauthorized).SendString("error: unauthorized")
+		}
 
-		_, err = uploads.InsertOne(ctx, File{
-			ID:      primitive.NewObjectID(),
-			User:    user.ID,
-			Name:   file.Filename,
-			Path: "./uploads/" + filename,
-		})
+		user, err := users.ByEmail(ctx, parsedToken.Email)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).SendString("error: unauthorized")
+		}
+
+		file, err := ownedFile(ctx, user, c.Params("id"))
+		if err == nil && file.Thumbnail == "" {
+			err = ErrNotFound
+		}
+		var r io.ReadCloser
+		if err == nil {
+			r, err = blobs.Open(ctx, file.Thumbnail)
+		}
+		if err == ErrNotFound {
+			return c.Status(fiber.StatusNotFound).SendString("error: thumbnail not found")
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("error: an unknown error occured")
+		}
+
+		// A file's thumbnail never changes.
+		c.Set(fiber.HeaderContentType, "image/jpeg")
+		c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+		return c.SendStream(r)
+	})
+
+	app.Get("/api/files/:id/download", func(c *fiber.Ctx) error {
+		token := c.Cookies("token", "")
+		if token == "" {
+			return c.Status(fiber.StatusUnauthorized).SendString("error: unauthorized")
+		}
+
+		parsedToken, err := parseJWT(token)
+		if err != nil {
+			c.ClearCookie(token)
+			return c.Status(fiber.StatusUnauthorized).SendString("error: unauthorized")
+		}
+
+		user, err := users.ByEmail(ctx, parsedToken.Email)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).SendString("error: unauthorized")
+		}
+
+		file, err := ownedFile(ctx, user, c.Params("id"))
+		if err == ErrNotFound {
+			return c.Status(fiber.StatusNotFound).SendString("error: file not found")
+		}
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).SendString("error: an unknown error occured")
 		}
 
-		return c.JSON(fiber.Map{"ok": "file uploaded successfully"})
+		r, err := openUpload(ctx, file)
+		if err == ErrNotFound {
+			return c.Status(fiber.StatusNotFound).SendString("error: file not found")
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("error: an unknown error occured")
+		}
 
+		mimeType := file.MIMEType
+		if mimeType == "" {
+			mimeType = fiber.MIMEOctetStream
+		}
+		c.Set(fiber.HeaderContentType, mimeType)
+		c.Set(fiber.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+
+		// The response closes r once it has been sent.
+		size := -1
+		if file.Size > 0 {
+			size = int(file.Size)
+		}
+		return c.SendStream(r, size)
 	})
 
 	app.Get("/chat/:id", func(c *fiber.Ctx) error {
 		token := c.Cookies("token", "")
 		id := c.Params("id", "new")
 
+		var err error
 		var parsedToken *TokenInfo
 
 		if token == "" {
@@ -436,8 +716,8 @@ func main() {
 			}
 		}
 
-		var user User
-		if err = users.FindOne(ctx, bson.M{"email": parsedToken.Email}).Decode(&user); err != nil {
+		user, err := users.ByEmail(ctx, parsedToken.Email)
+		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).SendString("error: unauthorized")
 		}
 
@@ -446,8 +726,8 @@ func main() {
 			// do something
 		}
 
-		var chat ContentChat
-		if err = chats.FindOne(ctx, bson.M{"_id": objID}).Decode(&chat); err != nil {
+		chat, err := chats.Get(ctx, objID)
+		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "none found: " + err.Error()})
 		}
 
@@ -455,19 +735,18 @@ func main() {
 			return c.Redirect("/", 302)
 		}
 
-		cursor, err := chats.Find(ctx, bson.M{"user": user.ID})
+		chatList, err := chats.ListByUser(ctx, user.ID)
 		if err != nil {
 			return fiber.ErrNotFound
 		}
 
-		var chatList []Chat
-		if err = cursor.All(ctx, &chatList); err != nil {
-			// idk
+		// Reloading the page during a generation picks it up again.
+		var generating string
+		if g, ok := generations.forChat(chat.ID); ok {
+			generating = g.id.Hex()
 		}
 
-		chatList = reverse(chatList)
-
-		return c.Render("chat", fiber.Map{"Chat": chat, "Chats": chatList})
+		return c.Render("chat", fiber.Map{"Chat": chat, "Chats": chatList, "Models": registry.Enabled(), "DefaultModel": registry.Default, "Generating": generating})
 	})
 
 	app.Get("/favicon.ico", func(c *fiber.Ctx) error {
@@ -497,28 +776,35 @@ func main() {
 			}
 		}
 
-		var user User
-		if err = users.FindOne(ctx, bson.M{"email": parsedToken.Email}).Decode(&user); err != nil {
+		user, err := users.ByEmail(ctx, parsedToken.Email)
+		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
 		}
 
-		var chat Chat
-		if err = chats.FindOne(ctx, bson.M{"_id": chatId}).Decode(&chat); err != nil {
+		chat, err := chats.Get(ctx, chatId)
+		if err != nil || chat.User != user.ID {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "chat not found"})
 		}
 
-		if _, err = chats.DeleteOne(ctx, bson.M{"_id": chatId}); err != nil {
+		if err = chats.Delete(ctx, chatId); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "unable to delete chat"})
 		}
+		hub.broadcast(user.ID, fiber.Map{"type": HubChatDeleted, "chatId": chatId.Hex()}, nil)
 
 		return c.JSON(fiber.Map{"ok": "chat deleted successfully"})
 	})
 
-	connect()
-	log.Fatal(app.Listen(":3000"))
+	return app
 }
 
+// connect opens the database named by CONNECTION_STRING: a MongoDB URI, or a
+// sqlite: or postgres:// URL for the SQL backend.
 func connect() {
+	if isSQLConnectionString(CONNECTION_STRING) {
+		connectSQL()
+		return
+	}
+
 	clientOptions := options.Client().
 		ApplyURI(CONNECTION_STRING)
 	client, err := mongo.Connect(ctx, clientOptions)
@@ -533,10 +819,66 @@ func connect() {
 
 	database = client.Database("geminui")
 
-	users = database.Collection("users")
-	chats = database.Collection("chats")
-	emailVerification = database.Collection("email-verification")
-	uploads = database.Collection("uploads")
+	unindexed, err := ensureIndexes(ctx, database)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	users = &mongoUserStore{c: database.Collection("users"), unindexed: unindexed["users"]}
+	chats = &mongoChatStore{c: database.Collection("chats")}
+	emailVerification = &mongoVerificationStore{c: database.Collection("email-verification")}
+	uploads = &mongoFileStore{c: database.Collection("uploads")}
+	migrations = mongoMigrations(database)
 
 	fmt.Println("Connected to MongoDB!")
 }
+
+// connectBlobStore opens the upload storage named by UPLOAD_STORAGE: "local"
+// (the default) keeps files in UPLOAD_DIR, "gridfs" in the MongoDB database
+// and "s3" in the S3_BUCKET of an S3-compatible service such as MinIO. Only
+// gridfs and s3 can be shared by several instances.
+func connectBlobStore() {
+	switch UPLOAD_STORAGE {
+	case "", "local":
+		blobs = newLocalBlobStore(UPLOAD_DIR)
+	case "gridfs":
+		if database == nil {
+			log.Fatal("UPLOAD_STORAGE=gridfs needs a MongoDB CONNECTION_STRING")
+		}
+		store, err := newGridFSBlobStore(database)
+		if err != nil {
+			log.Fatal(err)
+		}
+		blobs = store
+	case "s3":
+		if S3_ENDPOINT == "" || S3_BUCKET == "" {
+			log.Fatal("UPLOAD_STORAGE=s3 needs S3_ENDPOINT and S3_BUCKET")
+		}
+		store, err := newS3BlobStore(ctx, S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY, S3_SECRET_KEY, S3_REGION, S3_INSECURE != "true")
+		if err != nil {
+			log.Fatal(err)
+		}
+		blobs = store
+	default:
+		log.Fatalf("unknown UPLOAD_STORAGE %q, want local, gridfs or s3", UPLOAD_STORAGE)
+	}
+}
+
+func connectSQL() {
+	db, err := openSQL(ctx, CONNECTION_STRING)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	users = &sqlUserStore{db: db}
+	chats = &sqlChatStore{db: db}
+	emailVerification = &sqlVerificationStore{db: db}
+	uploads = &sqlFileStore{db: db}
+	migrations = sqlDataMigrations(db)
+
+	if db.postgres {
+		fmt.Println("Connected to PostgreSQL!")
+	} else {
+		fmt.Println("Connected to SQLite!")
+	}
+}
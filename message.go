@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// chatSchemaVersion is the layout of Chat documents written by this version
+// of GeminUI. Version 1 is the original history of genai-serialized
+// {parts: [string], role} entries; version 2 stores typed Messages; version
+// 3 stores them as a tree, with parents and a leaf, in place of the history.
+const chatSchemaVersion = 3
+
+// Part types.
+const (
+	PartText                = "text"
+	PartFile                = "file"
+	PartInlineData          = "inlineData"
+	PartFileData            = "fileData"
+	PartFunctionCall        = "functionCall"
+	PartFunctionResponse    = "functionResponse"
+	PartExecutableCode      = "executableCode"
+	PartCodeExecutionResult = "codeExecutionResult"
+)
+
+// Finish reasons, normalized across backends.
+const (
+	FinishStop      = "stop"
+	FinishMaxTokens = "max_tokens"
+	FinishSafety    = "safety"
+	FinishOther     = "other"
+	// FinishStopped marks answers cut short by the user, by stopping them
+	// or by leaving the page.
+	FinishStopped = "stopped"
+)
+
+// Message is one turn of a chat.
+type Message struct {
+	ID            primitive.ObjectID `bson:"_id" json:"id"`
+	Parent        primitive.ObjectID `bson:"parent,omitempty" json:"parent,omitempty"` // zero for the first messages
+	Role          string             `bson:"role" json:"role"`
+	Parts         []MessagePart      `bson:"parts" json:"parts"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+	Model         string             `bson:"model,omitempty" json:"model,omitempty"`
+	FinishReason  string             `bson:"finishReason,omitempty" json:"finishReason,omitempty"`
+	SafetyRatings []SafetyRating     `bson:"safetyRatings,omitempty" json:"safetyRatings,omitempty"`
+	Usage         *TokenUsage        `bson:"usage,omitempty" json:"usage,omitempty"`
+}
+
+// MessagePart is one ordered piece of a message. Type says which of the other
+// fields are set:
+//
+//   - text: Text
+//   - file: FileID, Blob, MIMEType and Name, a reference to an upload
+//   - inlineData: MIMEType and Data, such as an image the model returned
+//   - fileData: MIMEType and URI, a file stored by the model's backend
+//   - functionCall: Name and Args
+//   - functionResponse: Name and Response
+//   - executableCode: Language and the code in Text
+//   - codeExecutionResult: Outcome and the output in Text
+type MessagePart struct {
+	Type     string             `bson:"type" json:"type"`
+	Text     string             `bson:"text,omitempty" json:"text,omitempty"`
+	FileID   primitive.ObjectID `bson:"fileID,omitempty" json:"fileId,omitempty"`
+	MIMEType string             `bson:"mimeType,omitempty" json:"mimeType,omitempty"`
+	Blob     string             `bson:"blob,omitempty" json:"blob,omitempty"`
+	Data     []byte             `bson:"data,omitempty" json:"data,omitempty"`
+	URI      string             `bson:"uri,omitempty" json:"uri,omitempty"`
+	Name     string             `bson:"name,omitempty" json:"name,omitempty"`
+	Args     map[string]any     `bson:"args,omitempty" json:"args,omitempty"`
+	Response map[string]any     `bson:"response,omitempty" json:"response,omitempty"`
+	Language string             `bson:"language,omitempty" json:"language,omitempty"`
+	Outcome  string             `bson:"outcome,omitempty" json:"outcome,omitempty"`
+}
+
+type SafetyRating struct {
+	Category    string `bson:"category" json:"category"`
+	Probability string `bson:"probability" json:"probability"`
+	Blocked     bool   `bson:"blocked,omitempty" json:"blocked,omitempty"`
+}
+
+type TokenUsage struct {
+	PromptTokens    int `bson:"promptTokens" json:"promptTokens"`
+	CandidateTokens int `bson:"candidateTokens" json:"candidateTokens"`
+	TotalTokens     int `bson:"totalTokens" json:"totalTokens"`
+}
+
+// messagePart has MessagePart's fields without its custom decoding.
+type messagePart MessagePart
+
+// UnmarshalBSONValue also accepts the plain strings that schema version 1
+// chats stored as parts, so old chats stay readable before they are
+// migrated.
+func (p *MessagePart) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	if t == bsontype.String {
+		var text string
+		if err := bson.UnmarshalValue(t, data, &text); err != nil {
+			return err
+		}
+		*p = MessagePart{Type: PartText, Text: text}
+		return nil
+	}
+
+	return bson.UnmarshalValue(t, data, (*messagePart)(p))
+}
+
+// UnmarshalJSON accepts plain strings as text parts, like
+// UnmarshalBSONValue.
+func (p *MessagePart) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*p = MessagePart{Type: PartText, Text: text}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*messagePart)(p))
+}
+
+func textPart(text string) MessagePart {
+	return MessagePart{Type: PartText, Text: text}
+}
+
+// newMessage creates a message with a fresh ID.
+func newMessage(role string, parts ...MessagePart) Message {
+	return Message{
+		ID:        primitive.NewObjectID(),
+		Role:      role,
+		Parts:     parts,
+		CreatedAt: time.Now(),
+	}
+}
+
+// upgradeHistory fills in the message IDs and timestamps that schema
+// version 1 chats lack, so that everything written with the current schema
+// version really has them. Messages without a timestamp get created, usually
+// the time the chat was created.
+func upgradeHistory(history []Message, created time.Time) {
+	for i := range history {
+		if history[i].ID.IsZero() {
+			history[i].ID = primitive.NewObjectID()
+		}
+		if history[i].CreatedAt.IsZero() {
+			history[i].CreatedAt = created
+		}
+	}
+}
+
+// Text returns the concatenated text parts of the message.
+func (m *Message) Text() string {
+	var text strings.Builder
+	for _, part := range m.Parts {
+		if part.Type == PartText {
+			text.WriteString(part.Text)
+		}
+	}
+
+	return text.String()
+}
+
+// Markdown renders a part for the streamed answer, which the browser shows as
+// markdown. chat.html renders stored parts itself.
+func (p *MessagePart) Markdown() string {
+	switch p.Type {
+	case PartText:
+		return p.Text
+	case PartInlineData:
+		if strings.HasPrefix(p.MIMEType, "image/") {
+			return "\n\n![](data:" + p.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(p.Data) + ")\n\n"
+		}
+		return "\n\n*[" + p.MIMEType + " data]*\n\n"
+	case PartFileData:
+		return "\n\n[" + p.URI + "](" + p.URI + ")\n\n"
+	case PartFunctionCall:
+		args, _ := json.Marshal(p.Args)
+		return "\n\n`" + p.Name + "(" + string(args) + ")`\n\n"
+	case PartExecutableCode:
+		return "\n\n```" + p.Language + "\n" + p.Text + "\n```\n\n"
+	case PartCodeExecutionResult:
+		return "\n\n```\n" + p.Text + "\n```\n\n"
+	default:
+		return ""
+	}
+}
+
+// appendChunk adds a streamed chunk to a message being received, merging
+// consecutive text so a streamed answer is stored as one text part.
+func (m *Message) appendChunk(chunk *Chunk) {
+	for _, part := range chunk.Parts {
+		last := len(m.Parts) - 1
+		if part.Type == PartText && last >= 0 && m.Parts[last].Type == PartText {
+			m.Parts[last].Text += part.Text
+			continue
+		}
+		m.Parts = append(m.Parts, part)
+	}
+
+	if chunk.FinishReason != "" {
+		m.FinishReason = chunk.FinishReason
+	}
+	if chunk.SafetyRatings != nil {
+		m.SafetyRatings = chunk.SafetyRatings
+	}
+	if chunk.Usage != nil {
+		m.Usage = chunk.Usage
+	}
+}
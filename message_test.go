@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// mixedParts has one part of every type, with text parts around the others so
+// that merging or dropping parts shows up as a difference.
+func mixedParts() []MessagePart {
+	return []MessagePart{
+		textPart("Here is a chart:"),
+		{Type: PartInlineData, MIMEType: "image/png", Data: []byte("\x89PNG\r\n\x1a\nchart")},
+		textPart("and the code behind it."),
+		{Type: PartExecutableCode, Language: "python", Text: "print(1 + 1)"},
+		{Type: PartCodeExecutionResult, Outcome: "ok", Text: "2"},
+		{Type: PartFunctionCall, Name: "lookup", Args: map[string]any{"query": "weather"}},
+		{Type: PartFunctionResponse, Name: "lookup", Response: map[string]any{"forecast": "sunny"}},
+		{Type: PartFileData, MIMEType: "application/pdf", URI: "https://example.com/report.pdf"},
+		textPart("Done."),
+	}
+}
+
+func TestMixedPartsRoundTripThroughGenai(t *testing.T) {
+	parts := mixedParts()
+
+	got := convertFromGenaiParts(convertToGenaiParts(parts))
+	if !reflect.DeepEqual(got, parts) {
+		t.Errorf("round trip through genai:\ngot  %+v\nwant %+v", got, parts)
+	}
+
+	history := []Message{newMessage("user", parts...), newMessage("model", textPart("ok"))}
+	content := convertToGenaiContent(history)
+	if len(content) != 2 || len(content[0].Parts) != len(parts) {
+		t.Fatalf("convertToGenaiContent kept %d messages, want 2 with %d parts", len(content), len(parts))
+	}
+}
+
+func TestMixedPartsRoundTripThroughStorage(t *testing.T) {
+	ctx := context.Background()
+	parts := mixedParts()
+
+	// Mongo stores chats as BSON.
+	chat := Chat{ID: primitive.NewObjectID(), SchemaVersion: chatSchemaVersion}
+	chat.add(newMessage("model", parts...))
+	data, err := bson.Marshal(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Chat
+	if err := bson.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Messages[0].Parts, parts) {
+		t.Errorf("BSON round trip:\ngot  %+v\nwant %+v", decoded.Messages[0].Parts, parts)
+	}
+
+	// The SQL stores keep parts as JSON.
+	db, err := openSQL(ctx, "sqlite:"+filepath.Join(t.TempDir(), "geminui.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	user := &User{Email: "student@example.com", StudentID: "1"}
+	if err := (&sqlUserStore{db: db}).Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, store := range map[string]ChatStore{"sql": &sqlChatStore{db: db}, "memory": newMemoryChatStore()} {
+		chat := &Chat{User: user.ID}
+		chat.add(newMessage("user", textPart("draw a chart")), newMessage("model", parts...))
+		if err := store.Create(ctx, chat); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.Get(ctx, chat.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path := got.Path(); len(path) != 2 || !reflect.DeepEqual(path[1].Parts, parts) {
+			t.Errorf("%s store round trip:\ngot  %+v\nwant %+v", name, path, parts)
+		}
+	}
+}
+
+func TestAppendChunkKeepsPartOrder(t *testing.T) {
+	var message Message
+	for _, part := range mixedParts() {
+		// Split text across chunks the way a stream delivers it.
+		if part.Type == PartText {
+			half := len(part.Text) / 2
+			message.appendChunk(&Chunk{Parts: []MessagePart{textPart(part.Text[:half])}})
+			message.appendChunk(&Chunk{Parts: []MessagePart{textPart(part.Text[half:])}})
+			continue
+		}
+		message.appendChunk(&Chunk{Parts: []MessagePart{part}})
+	}
+
+	if !reflect.DeepEqual(message.Parts, mixedParts()) {
+		t.Errorf("got %+v\nwant %+v", message.Parts, mixedParts())
+	}
+}
+
+func TestChatPageRendersEveryPartType(t *testing.T) {
+	app, token := newTestApp(t)
+
+	user, err := users.ByEmail(context.Background(), "student@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat := &Chat{User: user.ID, Title: "Charts", Model: "fake"}
+	chat.add(
+		newMessage("user", textPart("draw a chart")),
+		newMessage("model", mixedParts()...),
+	)
+	if err := chats.Create(context.Background(), chat); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/chat/"+chat.ID.Hex(), nil)
+	req.Header.Set("Cookie", "token="+token)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"Here is a chart:",
+		`src="data:image/png;base64,`,
+		"and the code behind it.",
+		`class="language-python">print(1 &#43; 1)`,
+		"Output (ok)",
+		"<code>lookup</code>",
+		"&#34;query&#34;: &#34;weather&#34;",
+		"&#34;forecast&#34;: &#34;sunny&#34;",
+		`href="https://example.com/report.pdf"`,
+		"Done.",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("chat page is missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrationStep is one versioned data migration. Steps run in version order
+// and have to be safe to run while GeminUI is serving requests: they work in
+// batches and only touch documents that still need upgrading, so running a
+// step twice is harmless.
+type migrationStep struct {
+	Version int
+	Name    string
+	// Pending counts the documents the step would change.
+	Pending func(ctx context.Context) (int64, error)
+	// Run upgrades documents batchSize at a time and returns how many it
+	// changed.
+	Run func(ctx context.Context, batchSize int) (int64, error)
+}
+
+type migrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+	Documents int64     `bson:"documents"`
+}
+
+// migrationLog records which migration steps have run.
+type migrationLog interface {
+	Applied(ctx context.Context) (map[int]migrationRecord, error)
+	Record(ctx context.Context, record migrationRecord) error
+}
+
+type migrator struct {
+	log   migrationLog
+	steps []migrationStep
+}
+
+var migrations *migrator
+
+// runMigrate implements "geminui migrate up|status".
+func runMigrate(args []string) error {
+	usage := errors.New("usage: geminui migrate up|status [-dry-run] [-batch-size n]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would change without writing anything")
+	batchSize := flags.Int("batch-size", 100, "number of documents to upgrade at a time")
+	flags.Parse(args[1:])
+
+	if *batchSize < 1 {
+		return errors.New("-batch-size must be at least 1")
+	}
+
+	switch args[0] {
+	case "status":
+		return migrations.Status(ctx, os.Stdout)
+	case "up":
+		return migrations.Up(ctx, os.Stdout, *dryRun, *batchSize)
+	default:
+		return usage
+	}
+}
+
+// Pending returns the steps that have not been applied yet.
+func (m *migrator) Pending(ctx context.Context) ([]migrationStep, error) {
+	applied, err := m.log.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []migrationStep
+	for _, step := range m.steps {
+		if _, ok := applied[step.Version]; !ok {
+			pending = append(pending, step)
+		}
+	}
+
+	return pending, nil
+}
+
+func (m *migrator) Status(ctx context.Context, w io.Writer) error {
+	applied, err := m.log.Applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS")
+	for _, step := range m.steps {
+		if record, ok := applied[step.Version]; ok {
+			fmt.Fprintf(tw, "%d\t%s\tapplied %s, %d documents\n", step.Version, step.Name, record.AppliedAt.Format(time.RFC3339), record.Documents)
+			continue
+		}
+
+		n, err := step.Pending(ctx)
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", step.Version, err)
+		}
+		fmt.Fprintf(tw, "%d\t%s\tpending, %d documents\n", step.Version, step.Name, n)
+	}
+
+	return tw.Flush()
+}
+
+func (m *migrator) Up(ctx context.Context, w io.Writer, dryRun bool, batchSize int) error {
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		fmt.Fprintln(w, "Database is up to date.")
+		return nil
+	}
+
+	for _, step := range pending {
+		if dryRun {
+			n, err := step.Pending(ctx)
+			if err != nil {
+				return fmt.Errorf("migration %d: %w", step.Version, err)
+			}
+			fmt.Fprintf(w, "%d %s: would upgrade %d documents\n", step.Version, step.Name, n)
+			continue
+		}
+
+		n, err := step.Run(ctx, batchSize)
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", step.Version, err)
+		}
+
+		err = m.log.Record(ctx, migrationRecord{
+			Version:   step.Version,
+			Name:      step.Name,
+			AppliedAt: time.Now().UTC(),
+			Documents: n,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d %s: upgraded %d documents\n", step.Version, step.Name, n)
+	}
+
+	return nil
+}
+
+type mongoMigrationLog struct {
+	c *mongo.Collection
+}
+
+func (l *mongoMigrationLog) Applied(ctx context.Context) (map[int]migrationRecord, error) {
+	cursor, err := l.c.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []migrationRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]migrationRecord)
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+
+	return applied, nil
+}
+
+func (l *mongoMigrationLog) Record(ctx context.Context, record migrationRecord) error {
+	_, err := l.c.InsertOne(ctx, record)
+	return err
+}
+
+func mongoMigrations(db *mongo.Database) *migrator {
+	chats := db.Collection("chats")
+	files := db.Collection("uploads")
+
+	return &migrator{
+		log: &mongoMigrationLog{c: db.Collection("migrations")},
+		steps: []migrationStep{
+			{
+				Version: 1,
+				Name:    "typed chat messages",
+				Pending: func(ctx context.Context) (int64, error) {
+					return chats.CountDocuments(ctx, mongoChatsBeforeV2)
+				},
+				Run: func(ctx context.Context, batchSize int) (int64, error) {
+					return upgradeMongoChats(ctx, chats, batchSize)
+				},
+			},
+			{
+				Version: 2,
+				Name:    "content-addressed uploads",
+				Pending: func(ctx context.Context) (int64, error) {
+					return files.CountDocuments(ctx, mongoLegacyUploads)
+				},
+				Run: func(ctx context.Context, batchSize int) (int64, error) {
+					return upgradeMongoUploads(ctx, files, batchSize)
+				},
+			},
+			{
+				Version: 3,
+				Name:    "chat message trees",
+				Pending: func(ctx context.Context) (int64, error) {
+					return chats.CountDocuments(ctx, mongoChatsBeforeV3)
+				},
+				Run: func(ctx context.Context, batchSize int) (int64, error) {
+					return upgradeMongoChatTrees(ctx, chats, batchSize)
+				},
+			},
+		},
+	}
+}
+
+// mongoLegacyUploads matches uploads saved before the blob store.
+var mongoLegacyUploads = bson.M{"$or": bson.A{bson.M{"blob": bson.M{"$exists": false}}, bson.M{"blob": ""}}}
+
+// upgradeMongoUploads moves uploads saved before the blob store into it.
+// Uploads whose file is gone are logged and left as they are.
+func upgradeMongoUploads(ctx context.Context, c *mongo.Collection, batchSize int) (int64, error) {
+	var upgraded int64
+	var last primitive.ObjectID
+	for {
+		filter := bson.M{"$and": bson.A{mongoLegacyUploads, bson.M{"_id": bson.M{"$gt": last}}}}
+		cursor, err := c.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(batchSize)))
+		if err != nil {
+			return upgraded, err
+		}
+
+		var batch []File
+		if err := cursor.All(ctx, &batch); err != nil {
+			return upgraded, err
+		}
+		if len(batch) == 0 {
+			return upgraded, nil
+		}
+
+		for _, file := range batch {
+			last = file.ID
+
+			key, size, err := importLegacyUpload(ctx, file.Path)
+			if err != nil {
+				log.Printf("Skipping upload %s: %v", file.ID.Hex(), err)
+				continue
+			}
+
+			_, err = c.UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{"$set": bson.M{"blob": key, "size": size}})
+			if err != nil {
+				return upgraded, err
+			}
+			upgraded++
+		}
+	}
+}
+
+// importLegacyUpload puts a file saved before the blob store into it. The old
+// file is left in place, as several uploads may share it.
+func importLegacyUpload(ctx context.Context, path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	return blobs.Put(ctx, f)
+}
+
+// mongoChatsBeforeV2 matches chats written before schema version 2,
+// including those from before schemaVersion existed.
+var mongoChatsBeforeV2 = bson.M{"schemaVersion": bson.M{"$not": bson.M{"$gte": 2}}}
+
+// upgradeMongoChats rewrites schema version 1 chats as typed messages. Chat
+// decoding already understands the old parts, so this only has to fill in
+// message IDs and timestamps and save. A chat that the app writes in the
+// meantime is already upgraded and no longer matches the filter, so the
+// migration never overwrites newer history.
+func upgradeMongoChats(ctx context.Context, c *mongo.Collection, batchSize int) (int64, error) {
+	var upgraded int64
+	for {
+		cursor, err := c.Find(ctx, mongoChatsBeforeV2, options.Find().SetLimit(int64(batchSize)))
+		if err != nil {
+			return upgraded, err
+		}
+
+		// Chat itself reads old chats as schema version 3.
+		var batch []struct {
+			ID      primitive.ObjectID `bson:"_id"`
+			History []Message          `bson:"history"`
+		}
+		if err := cursor.All(ctx, &batch); err != nil {
+			return upgraded, err
+		}
+		if len(batch) == 0 {
+			return upgraded, nil
+		}
+
+		writes := make([]mongo.WriteModel, len(batch))
+		for i, chat := range batch {
+			upgradeHistory(chat.History, chat.ID.Timestamp())
+			writes[i] = mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"$and": bson.A{bson.M{"_id": chat.ID}, mongoChatsBeforeV2}}).
+				SetUpdate(bson.M{"$set": bson.M{"history": chat.History, "schemaVersion": 2}})
+		}
+
+		result, err := c.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return upgraded, err
+		}
+		upgraded += result.ModifiedCount
+	}
+}
+
+// mongoChatsBeforeV3 matches chats that keep their messages in a flat
+// history.
+var mongoChatsBeforeV3 = bson.M{"schemaVersion": bson.M{"$not": bson.M{"$gte": 3}}}
+
+// upgradeMongoChatTrees moves the history of older chats into messages, as a
+// single branch. Chat decoding already reads them that way, so this only has
+// to save them.
+func upgradeMongoChatTrees(ctx context.Context, c *mongo.Collection, batchSize int) (int64, error) {
+	var upgraded int64
+	for {
+		cursor, err := c.Find(ctx, mongoChatsBeforeV3, options.Find().SetLimit(int64(batchSize)))
+		if err != nil {
+			return upgraded, err
+		}
+
+		var batch []Chat
+		if err := cursor.All(ctx, &batch); err != nil {
+			return upgraded, err
+		}
+		if len(batch) == 0 {
+			return upgraded, nil
+		}
+
+		writes := make([]mongo.WriteModel, len(batch))
+		for i, chat := range batch {
+			writes[i] = mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"$and": bson.A{bson.M{"_id": chat.ID}, mongoChatsBeforeV3}}).
+				SetUpdate(bson.M{
+					"$set":   bson.M{"messages": chat.Messages, "leaf": chat.Leaf, "schemaVersion": 3},
+					"$unset": bson.M{"history": ""},
+				})
+		}
+
+		result, err := c.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return upgraded, err
+		}
+		upgraded += result.ModifiedCount
+	}
+}
+
+type sqlMigrationLog struct {
+	db *sqlDB
+}
+
+func (l *sqlMigrationLog) Applied(ctx context.Context) (map[int]migrationRecord, error) {
+	rows, err := l.db.query(ctx, `SELECT version, name, applied_at, documents FROM migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]migrationRecord)
+	for rows.Next() {
+		var record migrationRecord
+		var appliedAt int64
+		if err := rows.Scan(&record.Version, &record.Name, &appliedAt, &record.Documents); err != nil {
+			return nil, err
+		}
+		record.AppliedAt = time.UnixMilli(appliedAt).UTC()
+
+		applied[record.Version] = record
+	}
+
+	return applied, rows.Err()
+}
+
+func (l *sqlMigrationLog) Record(ctx context.Context, record migrationRecord) error {
+	_, err := l.db.exec(
+		ctx,
+		`INSERT INTO migrations (version, name, applied_at, documents) VALUES (?, ?, ?, ?)`,
+		record.Version, record.Name, record.AppliedAt.UnixMilli(), record.Documents,
+	)
+	return err
+}
+
+// sqlMigrations' schema changes are applied when the database is opened;
+// these are the data migrations that go with them.
+func sqlDataMigrations(db *sqlDB) *migrator {
+	return &migrator{
+		log: &sqlMigrationLog{db: db},
+		steps: []migrationStep{
+			{
+				Version: 1,
+				Name:    "typed chat messages",
+				Pending: func(ctx context.Context) (int64, error) {
+					var n int64
+					err := db.queryRow(ctx, `SELECT COUNT(*) FROM chats WHERE schema_version < 2`).Scan(&n)
+					return n, err
+				},
+				Run: func(ctx context.Context, batchSize int) (int64, error) {
+					return upgradeSQLChats(ctx, db, batchSize)
+				},
+			},
+			{
+				Version: 2,
+				Name:    "content-addressed uploads",
+				Pending: func(ctx context.Context) (int64, error) {
+					var n int64
+					err := db.queryRow(ctx, `SELECT COUNT(*) FROM uploads WHERE blob = ''`).Scan(&n)
+					return n, err
+				},
+				Run: func(ctx context.Context, batchSize int) (int64, error) {
+					return upgradeSQLUploads(ctx, db, batchSize)
+				},
+			},
+			{
+				Version: 3,
+				Name:    "chat message trees",
+				Pending: func(ctx context.Context) (int64, error) {
+					var n int64
+					err := db.queryRow(ctx, `SELECT COUNT(*) FROM chats WHERE schema_version < 3`).Scan(&n)
+					return n, err
+				},
+				Run: func(ctx context.Context, batchSize int) (int64, error) {
+					return upgradeSQLChatTrees(ctx, db, batchSize)
+				},
+			},
+		},
+	}
+}
+
+// upgradeSQLUploads is upgradeMongoUploads for the SQL backend.
+func upgradeSQLUploads(ctx context.Context, db *sqlDB, batchSize int) (int64, error) {
+	var upgraded int64
+	var last string
+	for {
+		rows, err := db.query(ctx, `SELECT id, path FROM uploads WHERE blob = '' AND id > ? ORDER BY id LIMIT ?`, last, batchSize)
+		if err != nil {
+			return upgraded, err
+		}
+
+		var ids, paths []string
+		for rows.Next() {
+			var id, path string
+			if err := rows.Scan(&id, &path); err != nil {
+				rows.Close()
+				return upgraded, err
+			}
+			ids = append(ids, id)
+			paths = append(paths, path)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return upgraded, err
+		}
+		if len(ids) == 0 {
+			return upgraded, nil
+		}
+
+		for i, id := range ids {
+			last = id
+
+			key, size, err := importLegacyUpload(ctx, paths[i])
+			if err != nil {
+				log.Printf("Skipping upload %s: %v", id, err)
+				continue
+			}
+
+			if _, err := db.exec(ctx, `UPDATE uploads SET blob = ?, size = ? WHERE id = ?`, key, size, id); err != nil {
+				return upgraded, err
+			}
+			upgraded++
+		}
+	}
+}
+
+func upgradeSQLChats(ctx context.Context, db *sqlDB, batchSize int) (int64, error) {
+	var upgraded int64
+	for {
+		rows, err := db.query(ctx, `SELECT id FROM chats WHERE schema_version < 2 LIMIT ?`, batchSize)
+		if err != nil {
+			return upgraded, err
+		}
+
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return upgraded, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return upgraded, err
+		}
+		if len(ids) == 0 {
+			return upgraded, nil
+		}
+
+		for _, id := range ids {
+			ok, err := upgradeSQLChat(ctx, db, id)
+			if err != nil {
+				return upgraded, fmt.Errorf("chat %s: %w", id, err)
+			}
+			if ok {
+				upgraded++
+			}
+		}
+	}
+}
+
+// upgradeSQLChat gives the messages of a schema version 1 chat IDs and
+// timestamps and rewrites their string parts as typed parts. It reports
+// false if the chat was upgraded by someone else in the meantime.
+func upgradeSQLChat(ctx context.Context, db *sqlDB, id string) (bool, error) {
+	chatID, err := scanID(id)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Claiming the chat first also locks it against a concurrent
+	// UpdateMessages, which updates the same row before it touches messages.
+	err = checkAffected(tx.ExecContext(
+		ctx,
+		db.rebind(`UPDATE chats SET schema_version = 2 WHERE id = ? AND schema_version < 2`),
+		id,
+	))
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		db.rebind(`SELECT position, id, parts, created_at FROM messages WHERE chat_id = ? ORDER BY position`),
+		id,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	type row struct {
+		position int
+		message  Message
+	}
+	var messages []row
+	for rows.Next() {
+		var r row
+		var messageID, parts string
+		var createdAt sql.NullInt64
+		if err := rows.Scan(&r.position, &messageID, &parts, &createdAt); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if messageID != "" {
+			if r.message.ID, err = scanID(messageID); err != nil {
+				rows.Close()
+				return false, err
+			}
+		}
+		if createdAt.Valid {
+			r.message.CreatedAt = time.UnixMilli(createdAt.Int64)
+		}
+		if err := json.Unmarshal([]byte(parts), &r.message.Parts); err != nil {
+			rows.Close()
+			return false, err
+		}
+
+		messages = append(messages, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	for _, r := range messages {
+		history := []Message{r.message}
+		upgradeHistory(history, chatID.Timestamp())
+
+		parts, err := json.Marshal(history[0].Parts)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			db.rebind(`UPDATE messages SET id = ?, parts = ?, created_at = ? WHERE chat_id = ? AND position = ?`),
+			history[0].ID.Hex(), string(parts), history[0].CreatedAt.UnixMilli(), id, r.position,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+// upgradeSQLChatTrees links the messages of older chats into a single
+// branch, in the order of their positions.
+func upgradeSQLChatTrees(ctx context.Context, db *sqlDB, batchSize int) (int64, error) {
+	var upgraded int64
+	for {
+		rows, err := db.query(ctx, `SELECT id FROM chats WHERE schema_version < 3 LIMIT ?`, batchSize)
+		if err != nil {
+			return upgraded, err
+		}
+
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return upgraded, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return upgraded, err
+		}
+		if len(ids) == 0 {
+			return upgraded, nil
+		}
+
+		for _, id := range ids {
+			ok, err := upgradeSQLChatTree(ctx, db, id)
+			if err != nil {
+				return upgraded, fmt.Errorf("chat %s: %w", id, err)
+			}
+			if ok {
+				upgraded++
+			}
+		}
+	}
+}
+
+// upgradeSQLChatTree sets the parents and leaf of an older chat. Messages
+// still without an ID, from schema version 1, get one. It reports false if
+// the chat was upgraded by someone else in the meantime.
+func upgradeSQLChatTree(ctx context.Context, db *sqlDB, id string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Claiming the chat first locks it, as in upgradeSQLChat.
+	err = checkAffected(tx.ExecContext(
+		ctx,
+		db.rebind(`UPDATE chats SET schema_version = 3 WHERE id = ? AND schema_version < 3`),
+		id,
+	))
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := tx.QueryContext(ctx, db.rebind(`SELECT position, id FROM messages WHERE chat_id = ? ORDER BY position`), id)
+	if err != nil {
+		return false, err
+	}
+
+	var positions []int
+	var messageIDs []string
+	for rows.Next() {
+		var position int
+		var messageID string
+		if err := rows.Scan(&position, &messageID); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if messageID == "" {
+			messageID = primitive.NewObjectID().Hex()
+		}
+		positions = append(positions, position)
+		messageIDs = append(messageIDs, messageID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	var parent string
+	for i, position := range positions {
+		_, err := tx.ExecContext(
+			ctx,
+			db.rebind(`UPDATE messages SET id = ?, parent = ? WHERE chat_id = ? AND position = ?`),
+			messageIDs[i], parent, id, position,
+		)
+		if err != nil {
+			return false, err
+		}
+		parent = messageIDs[i]
+	}
+
+	if _, err := tx.ExecContext(ctx, db.rebind(`UPDATE chats SET leaf = ? WHERE id = ?`), parent, id); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryMigrationLog is a migrationLog for tests.
+type memoryMigrationLog struct {
+	applied map[int]migrationRecord
+}
+
+func (l *memoryMigrationLog) Applied(ctx context.Context) (map[int]migrationRecord, error) {
+	applied := make(map[int]migrationRecord)
+	for version, record := range l.applied {
+		applied[version] = record
+	}
+	return applied, nil
+}
+
+func (l *memoryMigrationLog) Record(ctx context.Context, record migrationRecord) error {
+	l.applied[record.Version] = record
+	return nil
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+
+	// Each step upgrades the documents left in its slot of pending.
+	pending := []int64{3, 0, 2}
+	var ran []int
+	step := func(version int, name string, err error) migrationStep {
+		return migrationStep{
+			Version: version,
+			Name:    name,
+			Pending: func(ctx context.Context) (int64, error) {
+				return pending[version-1], nil
+			},
+			Run: func(ctx context.Context, batchSize int) (int64, error) {
+				ran = append(ran, version)
+				if err != nil {
+					return 0, err
+				}
+				n := pending[version-1]
+				pending[version-1] = 0
+				return n, nil
+			},
+		}
+	}
+
+	failure := errors.New("disk full")
+	log := &memoryMigrationLog{applied: make(map[int]migrationRecord)}
+	m := &migrator{log: log, steps: []migrationStep{step(1, "first", nil), step(2, "second", nil), step(3, "third", failure)}}
+
+	var out bytes.Buffer
+	if err := m.Status(ctx, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1        first   pending, 3 documents", "2        second  pending, 0 documents", "3        third   pending, 2 documents"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("status is\n%s\nwant a line %q", out.String(), want)
+		}
+	}
+
+	out.Reset()
+	if err := m.Up(ctx, &out, true, 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 0 || len(log.applied) != 0 || !strings.Contains(out.String(), "1 first: would upgrade 3 documents") {
+		t.Errorf("dry run ran %v, recorded %v and said\n%s", ran, log.applied, out.String())
+	}
+
+	// A failed step stops the migration and stays pending.
+	out.Reset()
+	if err := m.Up(ctx, &out, false, 10); !errors.Is(err, failure) {
+		t.Errorf("got %v, want the third step's error", err)
+	}
+	if !reflect.DeepEqual(ran, []int{1, 2, 3}) || len(log.applied) != 2 || log.applied[1].Documents != 3 || log.applied[2].Documents != 0 {
+		t.Errorf("ran %v and recorded %v, want the first two recorded", ran, log.applied)
+	}
+	if steps, err := m.Pending(ctx); err != nil || len(steps) != 1 || steps[0].Version != 3 {
+		t.Errorf("got pending steps %v, %v, want the third", steps, err)
+	}
+
+	// Applied steps don't run again.
+	m.steps[2] = step(3, "third", nil)
+	ran = nil
+	if err := m.Up(ctx, io.Discard, false, 10); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := m.Up(ctx, &out, false, 10); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ran, []int{3}) || out.String() != "Database is up to date.\n" {
+		t.Errorf("ran %v and said %q, want only the third step once", ran, out.String())
+	}
+
+	out.Reset()
+	if err := m.Status(ctx, &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "pending") || strings.Count(out.String(), "applied") != 3 {
+		t.Errorf("status is\n%s\nwant every step applied", out.String())
+	}
+}
+
+func TestSQLDataMigrations(t *testing.T) {
+	ctx := context.Background()
+	blobs = newLocalBlobStore(t.TempDir())
+
+	db, err := openSQL(ctx, "sqlite:"+filepath.Join(t.TempDir(), "geminui.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := db.exec(ctx, query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	user := &User{Email: "student@example.com", StudentID: "1"}
+	if err := (&sqlUserStore{db: db}).Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	// A chat as schema version 1 left it: string parts, no message IDs,
+	// timestamps, parents or leaf.
+	legacy := primitive.NewObjectIDFromTimestamp(time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC))
+	exec(`INSERT INTO chats (id, user_id, title, model, schema_version) VALUES (?, ?, 'Cells', 'fake', 1)`, legacy.Hex(), user.ID.Hex())
+	exec(`INSERT INTO messages (chat_id, position, role, parts) VALUES (?, 0, 'user', '["what is a cell?"]')`, legacy.Hex())
+	exec(`INSERT INTO messages (chat_id, position, role, parts) VALUES (?, 1, 'model', '["the unit ", "of life"]')`, legacy.Hex())
+
+	// A chat written by this version, which the migrations leave alone.
+	current := &Chat{User: user.ID, Title: "Current", Model: "fake"}
+	current.add(newMessage("user", textPart("hi")), newMessage("model", textPart("hello")))
+	if err := (&sqlChatStore{db: db}).Create(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+	current, err = (&sqlChatStore{db: db}).Get(ctx, current.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads from before the blob store, one of whose files is gone.
+	saved := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(saved, []byte("mitochondria"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	upload, lost := primitive.NewObjectID(), primitive.NewObjectID()
+	exec(`INSERT INTO uploads (id, user_id, name, path) VALUES (?, ?, 'notes.txt', ?)`, upload.Hex(), user.ID.Hex(), saved)
+	exec(`INSERT INTO uploads (id, user_id, name, path) VALUES (?, ?, 'lost.txt', ?)`, lost.Hex(), user.ID.Hex(), filepath.Join(t.TempDir(), "lost.txt"))
+
+	m := sqlDataMigrations(db)
+
+	status := func() string {
+		t.Helper()
+		var out bytes.Buffer
+		if err := m.Status(ctx, &out); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	before := status()
+	for _, want := range []string{"typed chat messages        pending, 1 documents", "content-addressed uploads  pending, 2 documents", "chat message trees         pending, 1 documents"} {
+		if !strings.Contains(before, want) {
+			t.Errorf("status is\n%s\nwant a line %q", before, want)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := m.Up(ctx, &out, true, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "1 typed chat messages: would upgrade 1 documents") || status() != before {
+		t.Errorf("dry run said\n%s\nand left the status\n%s", out.String(), status())
+	}
+
+	out.Reset()
+	if err := m.Up(ctx, &out, false, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1 typed chat messages: upgraded 1 documents", "2 content-addressed uploads: upgraded 1 documents", "3 chat message trees: upgraded 1 documents"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("migration said\n%s\nwant a line %q", out.String(), want)
+		}
+	}
+
+	chat, err := (&sqlChatStore{db: db}).Get(ctx, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := chat.Path()
+	if chat.SchemaVersion != chatSchemaVersion || len(chat.Messages) != 2 || len(path) != 2 {
+		t.Fatalf("upgraded chat is %+v, want a single branch of both messages", chat)
+	}
+	for i, message := range path {
+		if message.ID.IsZero() || !message.CreatedAt.Equal(legacy.Timestamp()) {
+			t.Errorf("message %d is %+v, want an ID and the chat's creation time", i, message)
+		}
+	}
+	if !path[0].Parent.IsZero() || path[1].Parent != path[0].ID || chat.Leaf != path[1].ID {
+		t.Errorf("upgraded chat is %+v, want the answer under the question", chat)
+	}
+	if want := []MessagePart{textPart("the unit "), textPart("of life")}; path[0].Text() != "what is a cell?" || !reflect.DeepEqual(path[1].Parts, want) {
+		t.Errorf("upgraded messages have parts %+v and %+v", path[0].Parts, path[1].Parts)
+	}
+
+	unchanged, err := (&sqlChatStore{db: db}).Get(ctx, current.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unchanged, current) {
+		t.Errorf("current chat became %+v", unchanged)
+	}
+
+	file, err := (&sqlFileStore{db: db}).Get(ctx, upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("mitochondria"))
+	if file.Blob != hex.EncodeToString(sum[:]) || file.Size != int64(len("mitochondria")) {
+		t.Errorf("upgraded upload is %+v, want it in the blob store", file)
+	}
+	if data, err := readBlob(ctx, file.Blob); err != nil || string(data) != "mitochondria" {
+		t.Errorf("blob has %q, %v", data, err)
+	}
+	if file, err := (&sqlFileStore{db: db}).Get(ctx, lost); err != nil || file.Blob != "" {
+		t.Errorf("lost upload became %+v, %v, want it left alone", file, err)
+	}
+
+	after := status()
+	if strings.Contains(after, "pending") || !strings.Contains(after, "applied") || !strings.Contains(after, "1 documents") {
+		t.Errorf("status is\n%s\nwant every step applied", after)
+	}
+
+	// Running again changes nothing, even the steps themselves.
+	out.Reset()
+	if err := m.Up(ctx, &out, false, 1); err != nil || out.String() != "Database is up to date.\n" {
+		t.Errorf("second migration said %q, %v", out.String(), err)
+	}
+	for _, step := range m.steps {
+		if n, err := step.Run(ctx, 1); err != nil || n != 0 {
+			t.Errorf("running %s again upgraded %d documents, %v", step.Name, n, err)
+		}
+	}
+	again, err := (&sqlChatStore{db: db}).Get(ctx, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, chat) {
+		t.Errorf("second migration changed the chat to %+v", again)
+	}
+	if status() != after {
+		t.Errorf("second migration changed the status to\n%s", status())
+	}
+}
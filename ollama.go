@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ollamaProvider talks to an Ollama server's native /api/chat endpoint.
+type ollamaProvider struct {
+	baseURL string
+	client  *http.Client
+}
+
+type ollamaModel struct {
+	provider *ollamaProvider
+	name     string
+	config   GenerationConfig
+}
+
+type ollamaSession struct {
+	model   *ollamaModel
+	system  string
+	history []Message
+}
+
+type ollamaStream struct {
+	ctx     context.Context
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	stop    func() bool
+	err     error
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Options  ollamaOptions   `json:"options"`
+}
+
+// ollamaMessage is a chatMessage as sent to Ollama, which takes images as
+// base64 strings beside the text.
+type ollamaMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  [][]byte `json:"images,omitempty"`
+}
+
+type ollamaOptions struct {
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	TopK        *int32   `json:"top_k,omitempty"`
+	NumPredict  *int32   `json:"num_predict,omitempty"`
+}
+
+type ollamaResponse struct {
+	Message         chatMessage `json:"message"`
+	Done            bool        `json:"done"`
+	DoneReason      string      `json:"done_reason"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+	EvalCount       int         `json:"eval_count"`
+	Error           string      `json:"error"`
+}
+
+func newOllamaProvider(baseURL string) *ollamaProvider {
+	return &ollamaProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  http.DefaultClient,
+	}
+}
+
+func (p *ollamaProvider) Model(name string, config GenerationConfig) ChatModel {
+	return &ollamaModel{provider: p, name: name, config: config}
+}
+
+func (p *ollamaProvider) Close() error {
+	return nil
+}
+
+func (p *ollamaProvider) post(ctx context.Context, body ollamaRequest) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/api/chat", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("ollama: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return resp, nil
+}
+
+func (m *ollamaModel) request(messages []chatMessage, stream bool) ollamaRequest {
+	var sent []ollamaMessage
+	for _, message := range messages {
+		v := ollamaMessage{Role: message.Role, Content: message.Content}
+		for _, image := range message.Images {
+			v.Images = append(v.Images, image.Data)
+		}
+		sent = append(sent, v)
+	}
+
+	return ollamaRequest{
+		Model:    m.name,
+		Messages: sent,
+		Stream:   stream,
+		Options: ollamaOptions{
+			Temperature: m.config.Temperature,
+			TopP:        m.config.TopP,
+			TopK:        m.config.TopK,
+			NumPredict:  m.config.MaxOutputTokens,
+		},
+	}
+}
+
+func (m *ollamaModel) StartChat(opts ChatOptions, history []Message) ChatSession {
+	return &ollamaSession{model: m, system: opts.SystemInstruction, history: slices.Clone(history)}
+}
+
+func (m *ollamaModel) GenerateContent(ctx context.Context, opts ChatOptions, prompt string) (string, error) {
+	messages, err := chatMessages(opts.SystemInstruction, nil, newMessage("user", textPart(prompt)))
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := m.provider.post(ctx, m.request(messages, false))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var response ollamaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	}
+
+	if response.Error != "" {
+		return "", errors.New("ollama: " + response.Error)
+	}
+
+	return response.Message.Content, nil
+}
+
+func (m *ollamaModel) CountTokens(ctx context.Context, text string) (int, error) {
+	return estimateTokens(text), nil
+}
+
+func (s *ollamaSession) SendMessageStream(ctx context.Context, message Message) Stream {
+	messages, err := chatMessages(s.system, s.history, message)
+	if err != nil {
+		return &ollamaStream{err: err}
+	}
+
+	resp, err := s.model.provider.post(ctx, s.model.request(messages, true))
+	if err != nil {
+		return &ollamaStream{err: err}
+	}
+
+	// Closing the body is what interrupts a read waiting for the server.
+	stop := context.AfterFunc(ctx, func() { resp.Body.Close() })
+	return &ollamaStream{ctx: ctx, body: resp.Body, scanner: newLineScanner(resp.Body), stop: stop}
+}
+
+func (s *ollamaStream) Next() (*Chunk, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	for s.scanner.Scan() {
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var response ollamaResponse
+		if err := json.Unmarshal(line, &response); err != nil {
+			return nil, s.finish(err)
+		}
+
+		if response.Error != "" {
+			return nil, s.finish(errors.New("ollama: " + response.Error))
+		}
+
+		chunk := &Chunk{}
+		if response.Message.Content != "" {
+			chunk.Parts = []MessagePart{textPart(response.Message.Content)}
+		}
+		if response.Done {
+			// Versions before done_reason only stop when they're done.
+			chunk.FinishReason = FinishStop
+			if response.DoneReason != "" {
+				chunk.FinishReason = openAIFinishReason(response.DoneReason)
+			}
+			chunk.Usage = &TokenUsage{
+				PromptTokens:    response.PromptEvalCount,
+				CandidateTokens: response.EvalCount,
+				TotalTokens:     response.PromptEvalCount + response.EvalCount,
+			}
+		}
+
+		return chunk, nil
+	}
+
+	if err := s.ctx.Err(); err != nil {
+		return nil, s.finish(err)
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, s.finish(err)
+	}
+
+	return nil, s.finish(io.EOF)
+}
+
+func (s *ollamaStream) finish(err error) error {
+	s.stop()
+	s.body.Close()
+	s.err = err
+	return err
+}
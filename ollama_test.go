@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOllamaStream(t *testing.T) {
+	server, got := serveChunks(t, http.StatusOK,
+		`{"message":{"role":"assistant","content":"Hel"},"done":false}`,
+		``,
+		`{"message":{"role":"assistant","content":"lo"},"done":false}`,
+		`{"message":{"role":"assistant","content":""},"done":true,"done_reason":"length","prompt_eval_count":3,"eval_count":2}`,
+	)
+
+	topK := int32(40)
+	model := newOllamaProvider(server.URL+"/").Model("llama", GenerationConfig{TopK: &topK})
+	history := []Message{newMessage("user", MessagePart{Type: PartInlineData, MIMEType: "image/png", Data: []byte("png")}, textPart("what's this?"))}
+	chunks, err := collect(model.StartChat(ChatOptions{SystemInstruction: "be brief"}, history).SendMessageStream(context.Background(), newMessage("user", textPart("hi"))))
+	if err != io.EOF {
+		t.Fatalf("stream ended with %v, want io.EOF", err)
+	}
+
+	var answer Message
+	for _, chunk := range chunks {
+		answer.appendChunk(chunk)
+	}
+	if answer.Text() != "Hello" || answer.FinishReason != FinishMaxTokens || answer.Usage == nil || answer.Usage.TotalTokens != 5 {
+		t.Errorf("got answer %+v, want every chunk", answer)
+	}
+
+	if options := fmt.Sprint((*got)["options"]); options != "map[top_k:40]" {
+		t.Errorf("sent options %s", options)
+	}
+	messages, _ := (*got)["messages"].([]any)
+	if len(messages) != 3 || fmt.Sprint(messages[1]) != "map[content:what's this? images:[cG5n] role:user]" || fmt.Sprint(messages[2]) != "map[content:hi role:user]" {
+		t.Errorf("sent messages %v", messages)
+	}
+}
+
+func TestOllamaStreamWithoutDoneReason(t *testing.T) {
+	// Older versions of Ollama don't say why they're done.
+	server, _ := serveChunks(t, http.StatusOK,
+		`{"message":{"role":"assistant","content":"Hello"},"done":false}`,
+		`{"message":{"role":"assistant","content":""},"done":true}`,
+	)
+	model := newOllamaProvider(server.URL).Model("llama", GenerationConfig{})
+	chunks, err := collect(model.StartChat(ChatOptions{}, nil).SendMessageStream(context.Background(), newMessage("user", textPart("hi"))))
+	if err != io.EOF {
+		t.Fatalf("stream ended with %v, want io.EOF", err)
+	}
+
+	var answer Message
+	for _, chunk := range chunks {
+		answer.appendChunk(chunk)
+	}
+	if answer.Text() != "Hello" || answer.FinishReason != FinishStop {
+		t.Errorf("got answer %+v, want it stopped normally", answer)
+	}
+}
+
+func TestOllamaErrors(t *testing.T) {
+	server, _ := serveChunks(t, http.StatusNotFound, `{"error":"model \"llama\" not found, try pulling it first"}`)
+	model := newOllamaProvider(server.URL).Model("llama", GenerationConfig{})
+
+	_, err := collect(model.StartChat(ChatOptions{}, nil).SendMessageStream(context.Background(), newMessage("user", textPart("hi"))))
+	if err == nil || !strings.Contains(err.Error(), "404") || !strings.Contains(err.Error(), "try pulling it first") {
+		t.Errorf("got %v, want the error status and body", err)
+	}
+	if _, err := model.GenerateContent(context.Background(), ChatOptions{}, "hi"); err == nil || !strings.Contains(err.Error(), "try pulling it first") {
+		t.Errorf("GenerateContent got %v, want the error body", err)
+	}
+
+	// Errors can also come in the middle of the stream.
+	server, _ = serveChunks(t, http.StatusOK, `{"message":{"content":"Hel"},"done":false}`, `{"error":"out of memory"}`)
+	model = newOllamaProvider(server.URL).Model("llama", GenerationConfig{})
+	chunks, err := collect(model.StartChat(ChatOptions{}, nil).SendMessageStream(context.Background(), newMessage("user", textPart("hi"))))
+	if len(chunks) != 1 || err == nil || err.Error() != "ollama: out of memory" {
+		t.Errorf("got %d chunks and %v, want the chunk before the error and the error", len(chunks), err)
+	}
+}
+
+func TestOllamaCancel(t *testing.T) {
+	server, gone := serveForever(t, `{"message":{"content":"Hel"},"done":false}`)
+	testCancel(t, newOllamaProvider(server.URL).Model("llama", GenerationConfig{}), gone)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// openAIProvider talks to any server implementing the OpenAI chat
+// completions API (OpenAI itself, llama.cpp server, vLLM, LocalAI...).
+type openAIProvider struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+type openAIModel struct {
+	provider *openAIProvider
+	name     string
+	config   GenerationConfig
+}
+
+type openAISession struct {
+	model   *openAIModel
+	system  string
+	history []Message
+}
+
+type openAIStream struct {
+	ctx     context.Context
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	stop    func() bool
+	err     error
+}
+
+// chatMessage is a message in the role/content form shared by the OpenAI
+// and Ollama APIs. Images holds the message's inline images, which each API
+// sends its own way.
+type chatMessage struct {
+	Role    string        `json:"role"`
+	Content string        `json:"content"`
+	Images  []MessagePart `json:"-"`
+}
+
+// openAIMessage is a chatMessage as sent to the OpenAI API. Content is the
+// text, or a list of openAIContentParts if the message has images.
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+type openAIContentPart struct {
+	Type     string       `json:"type"`
+	Text     string       `json:"text,omitempty"`
+	ImageURL *openAIImage `json:"image_url,omitempty"`
+}
+
+type openAIImage struct {
+	URL string `json:"url"`
+}
+
+// openAIRequest is a chat completion request. The API has no top_k, so
+// models' TopK parameter isn't sent.
+type openAIRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	Stream      bool            `json:"stream"`
+	Temperature *float32        `json:"temperature,omitempty"`
+	TopP        *float32        `json:"top_p,omitempty"`
+	MaxTokens   *int32          `json:"max_tokens,omitempty"`
+
+	// Streams only end with the token usage if asked to.
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message      chatMessage `json:"message"`
+		Delta        chatMessage `json:"delta"`
+		FinishReason string      `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+func newOpenAIProvider(baseURL, apiKey string) *openAIProvider {
+	return &openAIProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  http.DefaultClient,
+	}
+}
+
+func (p *openAIProvider) Model(name string, config GenerationConfig) ChatModel {
+	return &openAIModel{provider: p, name: name, config: config}
+}
+
+func (p *openAIProvider) Close() error {
+	return nil
+}
+
+func (p *openAIProvider) post(ctx context.Context, body openAIRequest) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("openai: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return resp, nil
+}
+
+func (m *openAIModel) request(messages []chatMessage, stream bool) openAIRequest {
+	request := openAIRequest{
+		Model:       m.name,
+		Stream:      stream,
+		Temperature: m.config.Temperature,
+		TopP:        m.config.TopP,
+		MaxTokens:   m.config.MaxOutputTokens,
+	}
+	if stream {
+		request.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+	}
+
+	for _, message := range messages {
+		if len(message.Images) == 0 {
+			request.Messages = append(request.Messages, openAIMessage{Role: message.Role, Content: message.Content})
+			continue
+		}
+
+		var content []openAIContentPart
+		if message.Content != "" {
+			content = append(content, openAIContentPart{Type: "text", Text: message.Content})
+		}
+		for _, image := range message.Images {
+			url := "data:" + image.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(image.Data)
+			content = append(content, openAIContentPart{Type: "image_url", ImageURL: &openAIImage{URL: url}})
+		}
+		request.Messages = append(request.Messages, openAIMessage{Role: message.Role, Content: content})
+	}
+
+	return request
+}
+
+func (m *openAIModel) StartChat(opts ChatOptions, history []Message) ChatSession {
+	return &openAISession{model: m, system: opts.SystemInstruction, history: slices.Clone(history)}
+}
+
+func (m *openAIModel) GenerateContent(ctx context.Context, opts ChatOptions, prompt string) (string, error) {
+	messages, err := chatMessages(opts.SystemInstruction, nil, newMessage("user", textPart(prompt)))
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := m.provider.post(ctx, m.request(messages, false))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var response openAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	}
+
+	if len(response.Choices) == 0 {
+		return "", errors.New("openai: empty response")
+	}
+
+	return response.Choices[0].Message.Content, nil
+}
+
+func (m *openAIModel) CountTokens(ctx context.Context, text string) (int, error) {
+	return estimateTokens(text), nil
+}
+
+func (s *openAISession) SendMessageStream(ctx context.Context, message Message) Stream {
+	messages, err := chatMessages(s.system, s.history, message)
+	if err != nil {
+		return &openAIStream{err: err}
+	}
+
+	resp, err := s.model.provider.post(ctx, s.model.request(messages, true))
+	if err != nil {
+		return &openAIStream{err: err}
+	}
+
+	// Closing the body is what interrupts a read waiting for the server.
+	stop := context.AfterFunc(ctx, func() { resp.Body.Close() })
+	return &openAIStream{ctx: ctx, body: resp.Body, scanner: newLineScanner(resp.Body), stop: stop}
+}
+
+func (s *openAIStream) Next() (*Chunk, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	for s.scanner.Scan() {
+		line := strings.TrimSpace(s.scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return nil, s.finish(io.EOF)
+		}
+
+		var response openAIResponse
+		if err := json.Unmarshal([]byte(data), &response); err != nil {
+			return nil, s.finish(err)
+		}
+
+		chunk := &Chunk{}
+		if len(response.Choices) > 0 {
+			if text := response.Choices[0].Delta.Content; text != "" {
+				chunk.Parts = []MessagePart{textPart(text)}
+			}
+			chunk.FinishReason = openAIFinishReason(response.Choices[0].FinishReason)
+		}
+		if response.Usage != nil {
+			chunk.Usage = &TokenUsage{
+				PromptTokens:    response.Usage.PromptTokens,
+				CandidateTokens: response.Usage.CompletionTokens,
+				TotalTokens:     response.Usage.TotalTokens,
+			}
+		}
+
+		return chunk, nil
+	}
+
+	if err := s.ctx.Err(); err != nil {
+		return nil, s.finish(err)
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, s.finish(err)
+	}
+
+	return nil, s.finish(io.EOF)
+}
+
+func (s *openAIStream) finish(err error) error {
+	s.stop()
+	s.body.Close()
+	s.err = err
+	return err
+}
+
+// openAIFinishReason normalizes the finish reasons used by the OpenAI and
+// Ollama APIs.
+func openAIFinishReason(reason string) string {
+	switch reason {
+	case "":
+		return ""
+	case "stop":
+		return FinishStop
+	case "length":
+		return FinishMaxTokens
+	case "content_filter":
+		return FinishSafety
+	default:
+		return FinishOther
+	}
+}
+
+// chatMessages builds the role/content message list shared by the OpenAI and
+// Ollama APIs. GeminUI stores Gemini's "model" role, which both call
+// "assistant".
+//
+// Both APIs take images only from the user, so those are the only parts
+// besides text that are sent. Other parts the user sent are refused, rather
+// than leaving the model to answer without them; other parts of answers,
+// such as images generated by another backend, are left out.
+func chatMessages(system string, history []Message, message Message) ([]chatMessage, error) {
+	var messages []chatMessage
+	if system != "" {
+		messages = append(messages, chatMessage{Role: "system", Content: system})
+	}
+
+	for _, v := range append(slices.Clone(history), message) {
+		role := v.Role
+		if role == "model" {
+			role = "assistant"
+		}
+
+		chat := chatMessage{Role: role, Content: v.Text()}
+		for _, part := range v.Parts {
+			switch {
+			case part.Type == PartText || role != "user":
+				// Already in Content, or left out.
+			case part.Type == PartInlineData && strings.HasPrefix(part.MIMEType, "image/"):
+				chat.Images = append(chat.Images, part)
+			case part.Type == PartInlineData || part.Type == PartFileData:
+				return nil, fmt.Errorf("%s attachments can't be sent to this model", part.MIMEType)
+			default:
+				return nil, fmt.Errorf("%s parts can't be sent to this model", part.Type)
+			}
+		}
+		messages = append(messages, chat)
+	}
+
+	return messages, nil
+}
+
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
+
+// estimateTokens approximates a token count for backends without a
+// tokenizer endpoint, using the common rule of thumb of four characters per
+// token.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
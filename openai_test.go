@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveChunks returns a server that answers every request with the given
+// lines, flushing each one, and records the request body it got last.
+func serveChunks(t *testing.T, status int, lines ...string) (*httptest.Server, *map[string]any) {
+	t.Helper()
+
+	var got map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("request body: %v", err)
+		}
+
+		w.WriteHeader(status)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &got
+}
+
+// collect reads a stream to the end, returning its chunks.
+func collect(stream Stream) ([]*Chunk, error) {
+	var chunks []*Chunk
+	for {
+		chunk, err := stream.Next()
+		if err != nil {
+			return chunks, err
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestOpenAIStream(t *testing.T) {
+	server, got := serveChunks(t, http.StatusOK,
+		`data: {"choices":[{"delta":{"role":"assistant","content":"Hel"}}]}`,
+		``,
+		`: keep-alive`,
+		`data: {"choices":[{"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+		`data: {"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		`data: [DONE]`,
+		`data: {"choices":[{"delta":{"content":"after done"}}]}`,
+	)
+
+	topK := int32(40)
+	model := newOpenAIProvider(server.URL+"/", "key").Model("gpt", GenerationConfig{TopK: &topK})
+	chunks, err := collect(model.StartChat(ChatOptions{SystemInstruction: "be brief"}, nil).SendMessageStream(context.Background(), newMessage("user", textPart("hi"))))
+	if err != io.EOF {
+		t.Fatalf("stream ended with %v, want io.EOF", err)
+	}
+
+	var answer Message
+	for _, chunk := range chunks {
+		answer.appendChunk(chunk)
+	}
+	if answer.Text() != "Hello" || answer.FinishReason != FinishStop || answer.Usage == nil || answer.Usage.TotalTokens != 5 {
+		t.Errorf("got answer %+v, want the chunks before [DONE]", answer)
+	}
+
+	if _, ok := (*got)["top_k"]; ok {
+		t.Errorf("sent top_k, which the chat completions API doesn't accept")
+	}
+	if options := fmt.Sprint((*got)["stream_options"]); options != "map[include_usage:true]" {
+		t.Errorf("sent stream options %s, want the usage asked for", options)
+	}
+	messages, _ := (*got)["messages"].([]any)
+	if len(messages) != 2 || fmt.Sprint(messages[0]) != "map[content:be brief role:system]" || fmt.Sprint(messages[1]) != "map[content:hi role:user]" {
+		t.Errorf("sent messages %v", messages)
+	}
+}
+
+func TestOpenAIImages(t *testing.T) {
+	server, got := serveChunks(t, http.StatusOK, `data: [DONE]`)
+	model := newOpenAIProvider(server.URL, "").Model("gpt", GenerationConfig{})
+
+	history := []Message{
+		newMessage("user", MessagePart{Type: PartInlineData, MIMEType: "image/png", Data: []byte("png")}, textPart("what's this?")),
+		newMessage("model", textPart("a cat"), MessagePart{Type: PartInlineData, MIMEType: "image/png", Data: []byte("drawn")}),
+	}
+	if _, err := collect(model.StartChat(ChatOptions{}, history).SendMessageStream(context.Background(), newMessage("user", textPart("thanks")))); err != io.EOF {
+		t.Fatalf("stream ended with %v, want io.EOF", err)
+	}
+
+	messages, _ := (*got)["messages"].([]any)
+	if len(messages) != 3 {
+		t.Fatalf("sent messages %v", messages)
+	}
+	want := "map[content:[map[text:what's this? type:text] map[image_url:map[url:data:image/png;base64,cG5n] type:image_url]] role:user]"
+	if got := fmt.Sprint(messages[0]); got != want {
+		t.Errorf("sent the image as %s, want %s", got, want)
+	}
+	if got := fmt.Sprint(messages[1]); got != "map[content:a cat role:assistant]" {
+		t.Errorf("sent the answer as %s, want its text", got)
+	}
+
+	// Other attachments can't be sent at all.
+	pdf := newMessage("user", MessagePart{Type: PartInlineData, MIMEType: "application/pdf", Data: []byte("%PDF")})
+	if _, err := collect(model.StartChat(ChatOptions{}, nil).SendMessageStream(context.Background(), pdf)); err == nil || !strings.Contains(err.Error(), "application/pdf") {
+		t.Errorf("sending a PDF got %v, want it refused", err)
+	}
+}
+
+func TestOpenAIErrors(t *testing.T) {
+	server, _ := serveChunks(t, http.StatusUnauthorized, `{"error":{"message":"invalid api key"}}`)
+	model := newOpenAIProvider(server.URL, "wrong").Model("gpt", GenerationConfig{})
+
+	_, err := collect(model.StartChat(ChatOptions{}, nil).SendMessageStream(context.Background(), newMessage("user", textPart("hi"))))
+	if err == nil || !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "invalid api key") {
+		t.Errorf("got %v, want the error status and body", err)
+	}
+	if _, err := model.GenerateContent(context.Background(), ChatOptions{}, "hi"); err == nil || !strings.Contains(err.Error(), "invalid api key") {
+		t.Errorf("GenerateContent got %v, want the error body", err)
+	}
+
+	server, _ = serveChunks(t, http.StatusOK, `data: {"choices":[{"delta":{"content":"Hel"}}]}`, `data: {not json`)
+	model = newOpenAIProvider(server.URL, "").Model("gpt", GenerationConfig{})
+	chunks, err := collect(model.StartChat(ChatOptions{}, nil).SendMessageStream(context.Background(), newMessage("user", textPart("hi"))))
+	if len(chunks) != 1 || err == nil || err == io.EOF {
+		t.Errorf("got %d chunks and %v, want the chunk before the invalid one and an error", len(chunks), err)
+	}
+}
+
+// serveForever returns a server that sends the line, then holds the response
+// open until the client goes away, and a channel closed when it does.
+func serveForever(t *testing.T, line string) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+
+	gone := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, line)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(gone)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, gone
+}
+
+// testCancel checks that cancelling a stream waiting for its server ends it
+// with the context's error and drops the connection.
+func testCancel(t *testing.T, model ChatModel, gone <-chan struct{}) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := model.StartChat(ChatOptions{}, nil).SendMessageStream(ctx, newMessage("user", textPart("hi")))
+	if chunk, err := stream.Next(); err != nil || len(chunk.Parts) != 1 {
+		t.Fatalf("got %+v, %v, want the first chunk", chunk, err)
+	}
+
+	next := make(chan error)
+	go func() {
+		_, err := stream.Next()
+		next <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-next:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled stream got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling didn't interrupt the stream")
+	}
+	select {
+	case <-gone:
+	case <-time.After(5 * time.Second):
+		t.Error("the connection was kept open")
+	}
+}
+
+func TestOpenAICancel(t *testing.T) {
+	server, gone := serveForever(t, `data: {"choices":[{"delta":{"content":"Hel"}}]}`)
+	testCancel(t, newOpenAIProvider(server.URL, "").Model("gpt", GenerationConfig{}), gone)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+)
+
+// Provider is a model backend (Gemini, a local model server, a fake used in
+// tests...) that can hand out chat models by name.
+type Provider interface {
+	Model(name string, config GenerationConfig) ChatModel
+	Close() error
+}
+
+// GenerationConfig holds the default sampling parameters for a model. Unset
+// fields are left to the backend's own defaults.
+type GenerationConfig struct {
+	Temperature     *float32 `json:"temperature,omitempty"`
+	TopP            *float32 `json:"topP,omitempty"`
+	TopK            *int32   `json:"topK,omitempty"`
+	MaxOutputTokens *int32   `json:"maxOutputTokens,omitempty"`
+}
+
+// ChatOptions holds per-request settings. A ChatModel is shared by every
+// request, so implementations apply these to the session or call they are
+// passed to and never to the model itself.
+type ChatOptions struct {
+	SystemInstruction string
+}
+
+// ChatModel is a single model exposed by a Provider. It is safe for
+// concurrent use.
+type ChatModel interface {
+	StartChat(opts ChatOptions, history []Message) ChatSession
+	GenerateContent(ctx context.Context, opts ChatOptions, prompt string) (string, error)
+	CountTokens(ctx context.Context, text string) (int, error)
+}
+
+// ChatSession is a conversation with a ChatModel, starting from the history
+// it was created with.
+type ChatSession interface {
+	SendMessageStream(ctx context.Context, message Message) Stream
+}
+
+// Stream yields the chunks of a streamed response. Next returns io.EOF once
+// the response is complete.
+type Stream interface {
+	Next() (*Chunk, error)
+}
+
+// Chunk is one piece of a streamed response. The metadata fields are only set
+// on the chunks where a backend reports them, usually the last one.
+type Chunk struct {
+	Parts         []MessagePart
+	FinishReason  string
+	SafetyRatings []SafetyRating
+	Usage         *TokenUsage
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeProvider is an in-process backend for tests. Its models answer every
+// message with the system instruction they were given followed by the
+// message itself, so tests can tell which request reached the model with
+// which options, and record the messages they're sent.
+//
+// Streamed messages that are exactly "wait" keep the stream open after the
+// answer until it's cancelled or released through fakeRelease; those that
+// are exactly "fail" fail after the answer. GenerateContent prompts ending
+// in "fail" fail without an answer; those ending in "hold" are answered once
+// released through fakeRelease.
+type fakeProvider struct{}
+
+// fakeRelease ends one waiting stream or held request for each value sent,
+// so a send also tells the test that one was waiting.
+var fakeRelease = make(chan struct{})
+
+type fakeModel struct {
+	name string
+
+	mu   sync.Mutex
+	sent []fakeRequest
+}
+
+// fakeRequest is a message sent to a fake model, with the history of the
+// chat it was sent in.
+type fakeRequest struct {
+	history []Message
+	message Message
+}
+
+type fakeSession struct {
+	model   *fakeModel
+	opts    ChatOptions
+	history []Message
+}
+
+type fakeStream struct {
+	ctx    context.Context
+	chunks []string
+	wait   bool
+	fail   bool
+}
+
+func (p *fakeProvider) Model(name string, config GenerationConfig) ChatModel {
+	return &fakeModel{name: name}
+}
+
+func (p *fakeProvider) Close() error {
+	return nil
+}
+
+func (m *fakeModel) StartChat(opts ChatOptions, history []Message) ChatSession {
+	return &fakeSession{model: m, opts: opts, history: history}
+}
+
+func (m *fakeModel) GenerateContent(ctx context.Context, opts ChatOptions, prompt string) (string, error) {
+	if strings.HasSuffix(prompt, "fail") {
+		return "", errors.New("backend unavailable")
+	}
+	if strings.HasSuffix(prompt, "hold") {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-fakeRelease:
+		}
+	}
+	return opts.SystemInstruction, nil
+}
+
+func (m *fakeModel) CountTokens(ctx context.Context, text string) (int, error) {
+	return estimateTokens(text), nil
+}
+
+func (s *fakeSession) SendMessageStream(ctx context.Context, message Message) Stream {
+	s.model.mu.Lock()
+	s.model.sent = append(s.model.sent, fakeRequest{history: s.history, message: message})
+	s.model.mu.Unlock()
+
+	return &fakeStream{
+		ctx:    ctx,
+		chunks: []string{s.opts.SystemInstruction, "\n", message.Text()},
+		wait:   message.Text() == "wait",
+		fail:   message.Text() == "fail",
+	}
+}
+
+func (s *fakeStream) Next() (*Chunk, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.chunks) == 0 {
+		if s.wait {
+			select {
+			case <-s.ctx.Done():
+				return nil, s.ctx.Err()
+			case <-fakeRelease:
+				s.wait = false
+				return &Chunk{FinishReason: FinishStop}, nil
+			}
+		}
+		if s.fail {
+			return nil, errors.New("backend unavailable")
+		}
+		return nil, io.EOF
+	}
+
+	chunk := &Chunk{Parts: []MessagePart{textPart(s.chunks[0])}}
+	s.chunks = s.chunks[1:]
+	if len(s.chunks) == 0 && !s.wait && !s.fail {
+		chunk.FinishReason = FinishStop
+	}
+	return chunk, nil
+}
+
+// lastSent returns the last message sent to the registry's model with an
+// ID, and the history it was sent with.
+func lastSent(t *testing.T, id string) fakeRequest {
+	t.Helper()
+
+	_, model, ok := registry.Get(id)
+	if !ok {
+		t.Fatalf("no model %q", id)
+	}
+	fake := model.(*fakeModel)
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if len(fake.sent) == 0 {
+		t.Fatalf("nothing was sent to %s", id)
+	}
+	return fake.sent[len(fake.sent)-1]
+}
+
+func readStream(stream Stream) (string, error) {
+	var answer Message
+	for {
+		chunk, err := stream.Next()
+		if err == io.EOF {
+			return answer.Text(), nil
+		}
+		if err != nil {
+			return answer.Text(), err
+		}
+		answer.appendChunk(chunk)
+	}
+}
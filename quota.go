@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// uploadLimits bound what users may upload. Quotas of 0 are unlimited.
+type uploadLimits struct {
+	MaxFileSize int64
+	UserQuota   int64
+	GroupQuota  int64
+}
+
+// limits are the upload limits in effect, set from UPLOAD_MAX_FILE_MB,
+// UPLOAD_USER_QUOTA_MB and UPLOAD_GROUP_QUOTA_MB.
+var limits = uploadLimits{
+	MaxFileSize: 20 << 20,
+	UserQuota:   200 << 20,
+}
+
+// parseMegabytes parses a size setting in megabytes, keeping def when the
+// setting is empty.
+func parseMegabytes(name, value string, def int64) (int64, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	mb, err := strconv.ParseFloat(value, 64)
+	if err != nil || mb < 0 {
+		return 0, fmt.Errorf("%s: %q is not a size in megabytes", name, value)
+	}
+
+	return int64(mb * (1 << 20)), nil
+}
+
+// QuotaError is returned when an upload would take a user or their group
+// past its storage quota.
+type QuotaError struct {
+	Group string // empty when it's the user's own quota
+	Used  int64
+	Limit int64
+}
+
+func (e *QuotaError) Error() string {
+	if e.Group != "" {
+		return fmt.Sprintf("this upload would exceed the storage quota of group %s (%s of %s used)", e.Group, formatSize(e.Used), formatSize(e.Limit))
+	}
+	return fmt.Sprintf("this upload would exceed your storage quota (%s of %s used)", formatSize(e.Used), formatSize(e.Limit))
+}
+
+// QuotaStatus is a user's storage use, as shown next to the upload button.
+// Limits of 0 are unlimited.
+type QuotaStatus struct {
+	Used        int64  `json:"used"`
+	Limit       int64  `json:"limit"`
+	Group       string `json:"group,omitempty"`
+	GroupUsed   int64  `json:"groupUsed,omitempty"`
+	GroupLimit  int64  `json:"groupLimit,omitempty"`
+	MaxFileSize int64  `json:"maxFileSize"`
+}
+
+func quotaStatus(ctx context.Context, user *User) (*QuotaStatus, error) {
+	used, err := uploads.UserUsage(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &QuotaStatus{Used: used, Limit: limits.UserQuota, MaxFileSize: limits.MaxFileSize}
+	if user.Group != "" {
+		status.Group = user.Group
+		status.GroupLimit = limits.GroupQuota
+		if status.GroupUsed, err = uploads.GroupUsage(ctx, user.Group); err != nil {
+			return nil, err
+		}
+	}
+
+	return status, nil
+}
+
+// checkQuota returns a QuotaError if storing size more bytes would take the
+// user or their group past its quota.
+func checkQuota(ctx context.Context, user *User, size int64) error {
+	status, err := quotaStatus(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	if status.Limit > 0 && status.Used+size > status.Limit {
+		return &QuotaError{Used: status.Used, Limit: status.Limit}
+	}
+	if status.Group != "" && status.GroupLimit > 0 && status.GroupUsed+size > status.GroupLimit {
+		return &QuotaError{Group: status.Group, Used: status.GroupUsed, Limit: status.GroupLimit}
+	}
+
+	return nil
+}
+
+// quotaLocks serializes the uploads counted against each quota, so that
+// concurrent uploads can't each fit on their own and go over it together.
+// Instances sharing a database don't see each other's locks.
+var quotaLocks = &keyedMutex{locks: make(map[string]*keyedLock)}
+
+// createWithinQuota stores an upload's record if its size fits in the
+// user's and their group's quotas, and returns a QuotaError if it doesn't.
+func createWithinQuota(ctx context.Context, user *User, file *File) error {
+	// Every lock is taken in the same order, group first.
+	if user.Group != "" {
+		defer quotaLocks.lock("group:" + user.Group)()
+	}
+	defer quotaLocks.lock("user:" + user.ID.Hex())()
+
+	if err := checkQuota(ctx, user, file.Size); err != nil {
+		return err
+	}
+
+	return uploads.Create(ctx, file)
+}
+
+// keyedMutex is a set of mutexes created on demand, one per key.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int // holders and waiters, the lock is forgotten at 0
+}
+
+// lock locks key's mutex and returns the function that unlocks it.
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		m.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// formatSize formats a byte count for people to read.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
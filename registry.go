@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ModelConfig describes one model entry in the model registry file.
+type ModelConfig struct {
+	ID            string           `json:"id"`
+	Name          string           `json:"name"`
+	Backend       string           `json:"backend"`
+	Model         string           `json:"model"` // name used by the backend, defaults to ID
+	Parameters    GenerationConfig `json:"parameters"`
+	ContextWindow int              `json:"contextWindow"`
+	Multimodal    bool             `json:"multimodal"`
+	// InputTypes lists the MIME types the model accepts as attachments, such
+	// as "application/pdf" or "image/*". Empty means defaultInputTypes for
+	// multimodal models. Text files are sent as text, so every model accepts
+	// them.
+	InputTypes []string `json:"inputTypes"`
+	Enabled    bool     `json:"enabled"`
+}
+
+// defaultInputTypes are the attachments multimodal models accept unless
+// their config says otherwise.
+var defaultInputTypes = []string{"image/*", "audio/*", "video/*", "application/pdf"}
+
+// Accepts reports whether the model can be sent a file of a MIME type.
+func (c ModelConfig) Accepts(mimeType string) bool {
+	if isTextMIMEType(mimeType) {
+		return true
+	}
+
+	inputTypes := c.InputTypes
+	if len(inputTypes) == 0 && c.Multimodal {
+		inputTypes = defaultInputTypes
+	}
+
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	for _, pattern := range inputTypes {
+		if pattern == mimeType || strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ModelRegistry is the set of models GeminUI serves, loaded from a JSON file
+// (models.json by default). Default is the model preselected for new chats and
+// Summarizer is the model used to generate chat titles; it may be disabled so
+// that it doesn't show up in the model switcher.
+type ModelRegistry struct {
+	Default    string        `json:"default"`
+	Summarizer string        `json:"summarizer"`
+	Models     []ModelConfig `json:"models"`
+
+	chat map[string]ChatModel
+}
+
+func loadModelRegistry(path string, providers map[string]Provider) (*ModelRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var registry ModelRegistry
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	registry.chat = make(map[string]ChatModel)
+	seen := make(map[string]bool)
+	for _, config := range registry.Models {
+		if config.ID == "" {
+			return nil, fmt.Errorf("%s: model without an id", path)
+		}
+		if seen[config.ID] {
+			return nil, fmt.Errorf("%s: duplicate model %q", path, config.ID)
+		}
+		seen[config.ID] = true
+
+		provider, ok := providers[config.Backend]
+		if !ok {
+			if !config.Enabled && config.ID != registry.Summarizer {
+				continue
+			}
+			return nil, fmt.Errorf("%s: model %q uses unconfigured backend %q", path, config.ID, config.Backend)
+		}
+
+		name := config.Model
+		if name == "" {
+			name = config.ID
+		}
+		registry.chat[config.ID] = provider.Model(name, config.Parameters)
+	}
+
+	if config, ok := registry.Config(registry.Default); !ok || !config.Enabled {
+		return nil, fmt.Errorf("%s: default model %q is not an enabled model", path, registry.Default)
+	}
+	if _, ok := registry.chat[registry.Summarizer]; !ok {
+		return nil, fmt.Errorf("%s: unknown summarizer model %q", path, registry.Summarizer)
+	}
+
+	return &registry, nil
+}
+
+// Config returns the registry entry for a model ID.
+func (r *ModelRegistry) Config(id string) (ModelConfig, bool) {
+	for _, config := range r.Models {
+		if config.ID == id {
+			return config, true
+		}
+	}
+
+	return ModelConfig{}, false
+}
+
+// Get returns an enabled model that users may chat with.
+func (r *ModelRegistry) Get(id string) (ModelConfig, ChatModel, bool) {
+	config, ok := r.Config(id)
+	if !ok || !config.Enabled {
+		return ModelConfig{}, nil, false
+	}
+
+	return config, r.chat[id], true
+}
+
+// Name returns the display name of a model, or its ID if it's no longer in
+// the registry.
+func (r *ModelRegistry) Name(id string) string {
+	if config, ok := r.Config(id); ok && config.Name != "" {
+		return config.Name
+	}
+
+	return id
+}
+
+// Enabled lists the models shown in the model switcher, in file order.
+func (r *ModelRegistry) Enabled() []ModelConfig {
+	var enabled []ModelConfig
+	for _, config := range r.Models {
+		if config.Enabled {
+			enabled = append(enabled, config)
+		}
+	}
+
+	return enabled
+}
+
+// Accepts reports whether any enabled model accepts files of a MIME type.
+func (r *ModelRegistry) Accepts(mimeType string) bool {
+	for _, config := range r.Enabled() {
+		if config.Accepts(mimeType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SummarizerModel returns the model used to title new chats.
+func (r *ModelRegistry) SummarizerModel() ChatModel {
+	return r.chat[r.Summarizer]
+}
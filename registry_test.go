@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestRegistry(t *testing.T, config string) (*ModelRegistry, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "models.json")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return loadModelRegistry(path, map[string]Provider{"fake": &fakeProvider{}})
+}
+
+func TestLoadModelRegistry(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string // empty if the registry is valid
+	}{
+		{
+			name: "valid",
+			config: `{"default": "a", "summarizer": "b", "models": [
+				{"id": "a", "backend": "fake", "enabled": true},
+				{"id": "b", "backend": "fake"}
+			]}`,
+		},
+		{
+			name: "disabled model of an unconfigured backend",
+			config: `{"default": "a", "summarizer": "a", "models": [
+				{"id": "a", "backend": "fake", "enabled": true},
+				{"id": "b", "backend": "elsewhere"}
+			]}`,
+		},
+		{
+			name:   "invalid JSON",
+			config: `{"default": "a",`,
+			err:    "unexpected end of JSON input",
+		},
+		{
+			name: "model without an id",
+			config: `{"default": "a", "summarizer": "a", "models": [
+				{"id": "a", "backend": "fake", "enabled": true},
+				{"backend": "fake", "enabled": true}
+			]}`,
+			err: "model without an id",
+		},
+		{
+			name: "duplicate id",
+			config: `{"default": "a", "summarizer": "a", "models": [
+				{"id": "a", "backend": "fake", "enabled": true},
+				{"id": "a", "backend": "fake"}
+			]}`,
+			err: `duplicate model "a"`,
+		},
+		{
+			name: "unknown backend",
+			config: `{"default": "a", "summarizer": "a", "models": [
+				{"id": "a", "backend": "fake", "enabled": true},
+				{"id": "b", "backend": "elsewhere", "enabled": true}
+			]}`,
+			err: `model "b" uses unconfigured backend "elsewhere"`,
+		},
+		{
+			name: "summarizer of an unknown backend",
+			config: `{"default": "a", "summarizer": "b", "models": [
+				{"id": "a", "backend": "fake", "enabled": true},
+				{"id": "b", "backend": "elsewhere"}
+			]}`,
+			err: `model "b" uses unconfigured backend "elsewhere"`,
+		},
+		{
+			name: "missing default",
+			config: `{"summarizer": "a", "models": [
+				{"id": "a", "backend": "fake", "enabled": true}
+			]}`,
+			err: `default model "" is not an enabled model`,
+		},
+		{
+			name: "unknown default",
+			config: `{"default": "b", "summarizer": "a", "models": [
+				{"id": "a", "backend": "fake", "enabled": true}
+			]}`,
+			err: `default model "b" is not an enabled model`,
+		},
+		{
+			name: "disabled default",
+			config: `{"default": "b", "summarizer": "a", "models": [
+				{"id": "a", "backend": "fake", "enabled": true},
+				{"id": "b", "backend": "fake"}
+			]}`,
+			err: `default model "b" is not an enabled model`,
+		},
+		{
+			name: "unknown summarizer",
+			config: `{"default": "a", "summarizer": "b", "models": [
+				{"id": "a", "backend": "fake", "enabled": true}
+			]}`,
+			err: `unknown summarizer model "b"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry, err := loadTestRegistry(t, test.config)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("got %v, want a valid registry", err)
+				}
+				if registry.SummarizerModel() == nil {
+					t.Error("the summarizer has no model")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestModelRegistryLookups(t *testing.T) {
+	registry, err := loadTestRegistry(t, `{"default": "text", "summarizer": "hidden", "models": [
+		{"id": "text", "name": "Text", "backend": "fake", "enabled": true},
+		{"id": "vision", "backend": "fake", "model": "vision-2", "multimodal": true, "enabled": true},
+		{"id": "pdf", "backend": "fake", "inputTypes": ["application/pdf"], "enabled": true},
+		{"id": "hidden", "backend": "fake", "multimodal": true}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, model, ok := registry.Get("vision"); !ok || model.(*fakeModel).name != "vision-2" {
+		t.Errorf("got %v, %v for vision, want the backend's vision-2", model, ok)
+	}
+	if _, _, ok := registry.Get("hidden"); ok {
+		t.Error("got a disabled model")
+	}
+	if _, _, ok := registry.Get("missing"); ok {
+		t.Error("got a missing model")
+	}
+	if name := registry.Name("text"); name != "Text" {
+		t.Errorf("text is named %q, want Text", name)
+	}
+	if name := registry.Name("vision"); name != "vision" {
+		t.Errorf("vision is named %q, want its ID", name)
+	}
+	if enabled := registry.Enabled(); len(enabled) != 3 || enabled[0].ID != "text" || enabled[2].ID != "pdf" {
+		t.Errorf("got enabled models %v, want text, vision and pdf in order", enabled)
+	}
+
+	accepts := []struct {
+		model    string
+		mimeType string
+		want     bool
+	}{
+		{"text", "text/plain; charset=utf-8", true},
+		{"text", "application/json", true},
+		{"text", "image/png", false},
+		{"vision", "image/png", true},
+		{"vision", "audio/mpeg", true},
+		{"vision", "application/pdf", true},
+		{"vision", "application/zip", false},
+		{"pdf", "application/pdf", true},
+		{"pdf", "image/png", false},
+		{"pdf", "text/markdown", true},
+	}
+	for _, test := range accepts {
+		config, _ := registry.Config(test.model)
+		if got := config.Accepts(test.mimeType); got != test.want {
+			t.Errorf("%s accepts %s: got %v, want %v", test.model, test.mimeType, got, test.want)
+		}
+	}
+
+	// Only enabled models count for the registry as a whole.
+	if !registry.Accepts("image/jpeg") || !registry.Accepts("application/pdf") || registry.Accepts("application/zip") {
+		t.Error("the registry accepts the wrong types")
+	}
+	registry.Models[1].Enabled = false
+	if registry.Accepts("image/jpeg") {
+		t.Error("the registry accepts images only a disabled model reads")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Server-sent events of /api/ask and /api/ask/:id/events, each with a JSON
+// object as data and numbered from 1 in its ID, which a client that lost the
+// connection sends back as Last-Event-ID to resume after it:
+//
+//   - meta: {"chatId", "messageId", "title"} first, with the title only for
+//     new chats; the message is the reply being generated
+//   - delta: {"text"}, the next piece of the answer as Markdown
+//   - usage: the reply's TokenUsage, when the backend reports it
+//   - error: {"code", "message"}, when the answer fails or can't be saved
+//   - done: {"finishReason"} last
+const (
+	EventMeta  = "meta"
+	EventDelta = "delta"
+	EventUsage = "usage"
+	EventError = "error"
+	EventDone  = "done"
+)
+
+// Error event codes.
+const (
+	ErrorCodeModel = "model_error" // the backend failed to generate the answer
+	ErrorCodeSave  = "save_failed" // the answer couldn't be saved to the chat
+)
+
+// sseHeartbeat is how long an event stream may be quiet before a comment is
+// sent, so that proxies don't time out a model that is slow to answer.
+var sseHeartbeat = 15 * time.Second
+
+// eventStream writes the events of one response. Once a write fails,
+// because the client has left, it drops the events after.
+type eventStream struct {
+	w      *bufio.Writer
+	failed bool
+}
+
+// send writes one event and flushes it to the client.
+func (s *eventStream) send(id int, event string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", event, err)
+		return
+	}
+
+	s.write("id: " + strconv.Itoa(id) + "\nevent: " + event + "\ndata: " + string(payload) + "\n\n")
+}
+
+// heartbeat writes a comment, which clients ignore.
+func (s *eventStream) heartbeat() {
+	s.write(": heartbeat\n\n")
+}
+
+func (s *eventStream) write(text string) {
+	if s.failed {
+		return
+	}
+
+	_, err := s.w.WriteString(text)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		s.failed = true
+	}
+}
+
+// follow sends a generation's events after the one with ID last as they
+// come, until the generation is done or the client leaves. Leaving doesn't
+// stop the generation, unless nobody follows it for generationAbandonment.
+func (s *eventStream) follow(g *generation, last int) {
+	defer g.attach()()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		events, done, changed := g.after(last)
+		for _, event := range events {
+			s.send(event.id, event.name, event.data)
+			last = event.id
+		}
+		if len(events) > 0 {
+			heartbeat.Reset(sseHeartbeat)
+		}
+		if done || s.failed {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			s.heartbeat()
+		}
+	}
+}
@@ -1,16 +1,328 @@
 let deleteChat = async (chatID) => {
     fetch(`/api/delete/${chatID}`, { method: "DELETE" }).then(response => {
         if (response.ok) {
-            const chatItem = document.querySelector(`.chat-item a[href="/chat/${chatID}"]`).closest("li");
-            chatItem.remove();
-
-            if (window.location.pathname.includes(`/chat/${chatID}`)) {
-                window.location.href = "/";
-            }
+            removeChatItem(chatID);
         } else {
             console.error("Failed to delete chat");
         }
     }).catch(error => {
         console.error("Error deleting chat: ", error)
     })
-}
\ No newline at end of file
+}
+
+let renameChat = async (chatID) => {
+    const link = document.querySelector(`.chat-item a[href="/chat/${chatID}"]`);
+    const title = prompt("Rename chat", link ? link.innerText : "");
+    if (!title || !title.trim()) return;
+
+    const formData = new FormData();
+    formData.append("title", title.trim());
+    fetch(`/api/chats/${chatID}`, { method: "PATCH", body: formData }).then(async response => {
+        if (response.ok) {
+            setChatTitle(chatID, title.trim());
+        } else {
+            console.error("Failed to rename chat:", (await response.json()).error);
+        }
+    }).catch(error => {
+        console.error("Error renaming chat: ", error)
+    })
+}
+
+// The sidebar's chats are kept the same in every tab: the server tells each
+// tab, over its WebSocket, about chats created, renamed and deleted in the
+// others.
+
+let addChatItem = (chatID, title) => {
+    if (document.querySelector(`.chat-item a[href="/chat/${chatID}"]`)) return;
+
+    const item = document.createElement("li");
+    const chatItem = document.createElement("div");
+    const link = document.createElement("a");
+    const rename = document.createElement("span");
+    const remove = document.createElement("span");
+
+    chatItem.classList.add("chat-item");
+    link.href = `/chat/${chatID}`;
+    link.setAttribute("hx-boost", "true");
+    link.innerText = title;
+    rename.classList.add("material-icons", "rename-button");
+    rename.innerText = "edit";
+    rename.onclick = () => renameChat(chatID);
+    remove.classList.add("material-icons", "delete-button");
+    remove.innerText = "delete";
+    remove.onclick = () => deleteChat(chatID);
+
+    chatItem.append(link, rename, remove);
+    item.appendChild(chatItem);
+
+    // Newest first, after "New Chat".
+    const list = document.getElementById("chat-list");
+    list.insertBefore(item, list.children[1] || null);
+    if (window.htmx) htmx.process(item);
+}
+
+let setChatTitle = (chatID, title) => {
+    const link = document.querySelector(`.chat-item a[href="/chat/${chatID}"]`);
+    if (link) link.innerText = title;
+}
+
+let removeChatItem = (chatID) => {
+    const link = document.querySelector(`.chat-item a[href="/chat/${chatID}"]`);
+    if (link) link.closest("li").remove();
+
+    if (window.location.pathname.includes(`/chat/${chatID}`)) {
+        window.location.href = "/";
+    }
+}
+
+// connectHub opens the page's WebSocket to /api/ws and calls handlers[type]
+// with each message the server sends, keeping the sidebar in sync itself.
+// It reconnects when the connection drops. It returns a function that sends
+// a message, which is dropped while disconnected.
+let connectHub = (handlers) => {
+    const url = (window.location.protocol === "https:" ? "wss://" : "ws://") + window.location.host + "/api/ws";
+    let socket = null;
+    let attempt = 0;
+
+    const sidebar = {
+        chat_created: (message) => addChatItem(message.chatId, message.title),
+        chat_renamed: (message) => setChatTitle(message.chatId, message.title),
+        chat_deleted: (message) => removeChatItem(message.chatId),
+    };
+
+    let connect = () => {
+        socket = new WebSocket(url);
+        socket.onopen = () => attempt = 0;
+        socket.onmessage = (event) => {
+            const message = JSON.parse(event.data);
+            if (sidebar[message.type]) sidebar[message.type](message);
+            if (handlers[message.type]) handlers[message.type](message);
+        };
+        socket.onclose = () => {
+            attempt++;
+            setTimeout(connect, 1000 * Math.min(attempt, 10));
+        };
+    };
+    connect();
+
+    return (message) => {
+        if (socket && socket.readyState === WebSocket.OPEN) socket.send(JSON.stringify(message));
+    };
+}
+
+// readEvents reads the server-sent events of a fetch response and calls
+// handlers[event] with each event's parsed JSON data, after passing its ID to
+// onEventID. Comments, such as heartbeats, are skipped.
+let readEvents = async (response, handlers, onEventID) => {
+    const reader = response.body.getReader();
+    const decoder = new TextDecoder();
+    let buffer = "";
+
+    let dispatch = (block) => {
+        let event = "message";
+        let id = null;
+        let data = [];
+        block.split("\n").forEach(line => {
+            if (line.startsWith(":")) return;
+            const colon = line.indexOf(":");
+            const field = colon < 0 ? line : line.slice(0, colon);
+            let value = colon < 0 ? "" : line.slice(colon + 1);
+            if (value.startsWith(" ")) value = value.slice(1);
+            if (field === "event") event = value;
+            if (field === "id") id = value;
+            if (field === "data") data.push(value);
+        });
+        if (id !== null && onEventID) onEventID(id);
+        if (data.length && handlers[event]) handlers[event](JSON.parse(data.join("\n")));
+    }
+
+    while (true) {
+        const { value, done } = await reader.read();
+        buffer += decoder.decode(value, { stream: !done });
+
+        const blocks = buffer.replace(/\r\n?/g, "\n").split("\n\n");
+        buffer = blocks.pop();
+        blocks.forEach(dispatch);
+
+        if (done) break;
+    }
+    if (buffer.trim()) dispatch(buffer);
+}
+
+// streamAnswer reads the events of an answer from a response of /api/ask or
+// /api/ask/:id/events. The answer keeps being generated if the connection
+// drops, so streamAnswer then reconnects and resumes after the last event it
+// got. handlers.expired is called if the answer has finished so long ago that
+// it can't be resumed; it is in the chat by then.
+let streamAnswer = async (response, handlers) => {
+    let messageID = null;
+    let lastEventID = 0;
+    let finished = false;
+
+    const tracked = Object.assign({}, handlers, {
+        meta: (meta) => {
+            messageID = meta.messageId;
+            if (handlers.meta) handlers.meta(meta);
+        },
+        done: (done) => {
+            finished = true;
+            if (handlers.done) handlers.done(done);
+        },
+    });
+
+    for (let attempt = 1; ; attempt++) {
+        try {
+            await readEvents(response, tracked, (id) => lastEventID = id);
+        } catch (e) {
+            console.error("Lost the connection to the answer:", e);
+        }
+        if (finished || !messageID || attempt > 10) return;
+
+        await new Promise(resolve => setTimeout(resolve, 1000 * Math.min(attempt, 5)));
+        try {
+            response = await fetch(`/api/ask/${messageID}/events`, { headers: { "Last-Event-ID": lastEventID } });
+        } catch (e) {
+            response = null;
+            continue;
+        }
+        if (response.status === 404) {
+            if (handlers.expired) handlers.expired();
+            return;
+        }
+    }
+}
+
+// ID of the answer being generated, which the stop button cancels.
+let generating = null;
+
+let showGenerating = (id) => {
+    generating = id;
+    document.getElementById("stop").classList.toggle("is-hidden", !id);
+}
+
+let stopGeneration = () => {
+    if (generating) fetch(`/api/ask/${generating}/cancel`, { method: "POST" });
+}
+
+// Files attached to the next message, as returned by /api/upload.
+let attachments = [];
+
+let renderAttachments = () => {
+    const list = document.getElementById("attachments");
+    list.innerHTML = "";
+
+    attachments.forEach((attachment, i) => {
+        const tag = document.createElement("span");
+        const remove = document.createElement("button");
+
+        tag.classList.add("tag", "is-medium");
+        if (attachment.thumbnail) {
+            const thumbnail = document.createElement("img");
+            thumbnail.classList.add("thumbnail", "is-small", "mr-1");
+            thumbnail.src = attachment.thumbnail;
+            tag.appendChild(thumbnail);
+        }
+        tag.appendChild(document.createTextNode(attachment.name));
+        remove.classList.add("delete", "is-small");
+        remove.onclick = () => {
+            attachments.splice(i, 1);
+            renderAttachments();
+        };
+
+        tag.appendChild(remove);
+        list.appendChild(tag);
+    });
+}
+
+let formatSize = (bytes) => {
+    if (bytes >= 1 << 30) return (bytes / (1 << 30)).toFixed(1) + " GB";
+    if (bytes >= 1 << 20) return (bytes / (1 << 20)).toFixed(1) + " MB";
+    if (bytes >= 1 << 10) return (bytes / (1 << 10)).toFixed(1) + " KB";
+    return bytes + " bytes";
+}
+
+// The user's storage use and limits, as returned by /api/quota.
+let quota = null;
+
+// showQuota shows the user's storage use, or instead a message, which is an
+// error unless kind says otherwise ("is-warning").
+let showQuota = async (message, kind) => {
+    const help = document.getElementById("quota");
+
+    try {
+        const response = await fetch("/api/quota");
+        if (response.ok) quota = await response.json();
+    } catch (e) {
+        console.error("Error loading quota:", e);
+    }
+
+    help.classList.remove("is-danger", "is-warning");
+    if (message) {
+        help.classList.add(kind || "is-danger");
+        help.innerText = message;
+        return;
+    }
+    if (!quota) return;
+
+    let text = formatSize(quota.used) + (quota.limit ? " of " + formatSize(quota.limit) : "") + " of storage used";
+    if (quota.group && quota.groupLimit) {
+        text += ", " + formatSize(quota.groupUsed) + " of " + formatSize(quota.groupLimit) + " by " + quota.group;
+    }
+    help.innerText = text + ". Files up to " + formatSize(quota.maxFileSize) + ".";
+}
+
+let uploadAttachments = async (files) => {
+    const attach = document.getElementById("attach");
+    const attachIcon = document.getElementById("attach-icon");
+    const model = document.getElementById("model-select");
+    attach.classList.add("is-loading");
+    attachIcon.innerText = "attach_file";
+
+    let error = "";
+    let warning = "";
+    for (const file of files) {
+        if (quota && file.size > quota.maxFileSize) {
+            error = `${file.name} is larger than the ${formatSize(quota.maxFileSize)} limit`;
+            continue;
+        }
+
+        const formData = new FormData();
+        formData.append("file", file);
+        if (model) formData.append("model", model.value);
+
+        try {
+            const response = await fetch("/api/upload", { method: "POST", body: formData });
+            const body = await response.json().catch(() => ({ error: response.statusText }));
+            if (response.ok) {
+                attachments.push(body);
+                if (body.warning) warning = body.warning;
+            } else {
+                console.error("File upload failed:", body.error);
+                error = body.error;
+            }
+        } catch (e) {
+            console.error("Error uploading file:", e);
+            error = "couldn't upload " + file.name;
+        }
+    }
+
+    if (error) attachIcon.innerText = "error";
+    attach.classList.remove("is-loading");
+    document.getElementById("fileUpload").value = "";
+    renderAttachments();
+    showQuota(error || warning, error ? "is-danger" : "is-warning");
+}
+
+// takeAttachments adds the attached files to a message's form data and clears
+// them, returning a markdown line listing them for the sent message.
+let takeAttachments = (formData) => {
+    const names = attachments.map(attachment => {
+        formData.append("files", attachment.id);
+        return "`" + attachment.name + "`";
+    });
+
+    attachments = [];
+    renderAttachments();
+
+    return names.length ? "📎 " + names.join(", ") + "\n\n" : "";
+}
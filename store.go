@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNotFound is returned by stores when the requested record doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// DuplicateError is returned when a record would break a uniqueness
+// guarantee, such as two users sharing an email address. Field names the
+// duplicated field ("email" or "studentID") when the database reports it.
+type DuplicateError struct {
+	Field string
+}
+
+func (e *DuplicateError) Error() string {
+	if e.Field == "" {
+		return "duplicate key"
+	}
+	return "duplicate " + e.Field
+}
+
+// verificationLifetime is how long an emailed verification code stays valid.
+const verificationLifetime = 15 * time.Minute
+
+func verificationExpired(verification *Verification) bool {
+	return time.Since(verification.CreatedAt) > verificationLifetime
+}
+
+// UserStore persists user accounts.
+type UserStore interface {
+	Create(ctx context.Context, user *User) error
+	ByID(ctx context.Context, id primitive.ObjectID) (*User, error)
+	ByEmail(ctx context.Context, email string) (*User, error)
+	// AddToken records a newly issued JWT ID for the user and marks their
+	// email address as verified.
+	AddToken(ctx context.Context, email, jti string) error
+}
+
+// ChatStore persists chats and their messages.
+type ChatStore interface {
+	Create(ctx context.Context, chat *Chat) error
+	Get(ctx context.Context, id primitive.ObjectID) (*Chat, error)
+	// ListByUser returns a user's chats, newest first.
+	ListByUser(ctx context.Context, userID primitive.ObjectID) ([]Chat, error)
+	Newest(ctx context.Context, userID primitive.ObjectID) (*Chat, error)
+	// UpdateMessages saves a chat's messages, on every branch, and the leaf
+	// of the one shown.
+	UpdateMessages(ctx context.Context, id primitive.ObjectID, messages []Message, leaf primitive.ObjectID) error
+	// SetLeaf shows another branch of a chat.
+	SetLeaf(ctx context.Context, id, leaf primitive.ObjectID) error
+	Rename(ctx context.Context, id primitive.ObjectID, title string) error
+	// SetModel changes the model a chat's questions go to by default.
+	SetModel(ctx context.Context, id primitive.ObjectID, model string) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// BlobRefs counts the message parts referencing each blob.
+	BlobRefs(ctx context.Context) (map[string]int, error)
+	// FileChats maps the ID of each file attached in a user's chats to those
+	// chats, newest first. Only the chats' IDs and titles are filled in.
+	FileChats(ctx context.Context, userID primitive.ObjectID) (map[primitive.ObjectID][]Chat, error)
+}
+
+// FileStore persists the records of uploaded files.
+type FileStore interface {
+	Create(ctx context.Context, file *File) error
+	// Get is the only method that loads a file's extracted Text.
+	Get(ctx context.Context, id primitive.ObjectID) (*File, error)
+	ListByUser(ctx context.Context, userID primitive.ObjectID) ([]File, error)
+	Rename(ctx context.Context, id primitive.ObjectID, name string) error
+	// Delete removes a File record. Its blob is left to the garbage
+	// collector, since other records and chat messages may share it.
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// ByBlob finds a user's existing upload of the same contents.
+	ByBlob(ctx context.Context, userID primitive.ObjectID, key string) (*File, error)
+	// BlobRefs counts the File records referencing each blob, as contents
+	// or as a thumbnail.
+	BlobRefs(ctx context.Context) (map[string]int, error)
+	// UserUsage and GroupUsage total the size of a user's or a group's
+	// files, which is what upload quotas limit.
+	UserUsage(ctx context.Context, userID primitive.ObjectID) (int64, error)
+	GroupUsage(ctx context.Context, group string) (int64, error)
+}
+
+// VerificationStore persists pending email verification codes. Get treats
+// codes older than verificationLifetime as not found.
+type VerificationStore interface {
+	Create(ctx context.Context, verification *Verification) error
+	Get(ctx context.Context, id primitive.ObjectID) (*Verification, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
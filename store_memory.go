@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The memory stores keep everything in maps. They are used by tests so the
+// HTTP handlers can run without a database.
+
+type memoryUserStore struct {
+	mu    sync.RWMutex
+	users map[primitive.ObjectID]User
+}
+
+type memoryChatStore struct {
+	mu    sync.RWMutex
+	chats map[primitive.ObjectID]Chat
+}
+
+type memoryFileStore struct {
+	mu    sync.RWMutex
+	files map[primitive.ObjectID]File
+}
+
+type memoryVerificationStore struct {
+	mu            sync.RWMutex
+	verifications map[primitive.ObjectID]Verification
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{users: make(map[primitive.ObjectID]User)}
+}
+
+func newMemoryChatStore() *memoryChatStore {
+	return &memoryChatStore{chats: make(map[primitive.ObjectID]Chat)}
+}
+
+func newMemoryFileStore() *memoryFileStore {
+	return &memoryFileStore{files: make(map[primitive.ObjectID]File)}
+}
+
+func newMemoryVerificationStore() *memoryVerificationStore {
+	return &memoryVerificationStore{verifications: make(map[primitive.ObjectID]Verification)}
+}
+
+func (s *memoryUserStore) Create(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	if user.JTI == nil {
+		user.JTI = []string{}
+	}
+
+	for _, other := range s.users {
+		switch {
+		case other.Email == user.Email:
+			return &DuplicateError{Field: "email"}
+		case other.StudentID == user.StudentID:
+			return &DuplicateError{Field: "studentID"}
+		}
+	}
+
+	s.users[user.ID] = cloneUser(*user)
+	return nil
+}
+
+func (s *memoryUserStore) ByID(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	user = cloneUser(user)
+	return &user, nil
+}
+
+func (s *memoryUserStore) ByEmail(ctx context.Context, email string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.Email == email {
+			user = cloneUser(user)
+			return &user, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *memoryUserStore) AddToken(ctx context.Context, email, jti string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, user := range s.users {
+		if user.Email == email {
+			user.JTI = append(slices.Clone(user.JTI), jti)
+			user.EmailVerified = true
+			s.users[id] = user
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func cloneUser(user User) User {
+	user.JTI = slices.Clone(user.JTI)
+	return user
+}
+
+func (s *memoryChatStore) Create(ctx context.Context, chat *Chat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if chat.ID.IsZero() {
+		chat.ID = primitive.NewObjectID()
+	}
+	upgradeHistory(chat.Messages, chat.ID.Timestamp())
+	chat.SchemaVersion = chatSchemaVersion
+
+	s.chats[chat.ID] = cloneChat(*chat)
+	return nil
+}
+
+func (s *memoryChatStore) Get(ctx context.Context, id primitive.ObjectID) (*Chat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chat, ok := s.chats[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	chat = cloneChat(chat)
+	return &chat, nil
+}
+
+func (s *memoryChatStore) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]Chat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var chatList []Chat
+	for _, chat := range s.chats {
+		if chat.User == userID {
+			chatList = append(chatList, cloneChat(chat))
+		}
+	}
+
+	slices.SortFunc(chatList, func(a, b Chat) int { return bytes.Compare(b.ID[:], a.ID[:]) })
+	return chatList, nil
+}
+
+func (s *memoryChatStore) Newest(ctx context.Context, userID primitive.ObjectID) (*Chat, error) {
+	chatList, err := s.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(chatList) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &chatList[0], nil
+}
+
+func (s *memoryChatStore) UpdateMessages(ctx context.Context, id primitive.ObjectID, messages []Message, leaf primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, ok := s.chats[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	upgradeHistory(messages, id.Timestamp())
+	chat.Messages = messages
+	chat.Leaf = leaf
+	chat.SchemaVersion = chatSchemaVersion
+	s.chats[id] = cloneChat(chat)
+	return nil
+}
+
+func (s *memoryChatStore) SetLeaf(ctx context.Context, id, leaf primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, ok := s.chats[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	chat.Leaf = leaf
+	s.chats[id] = chat
+	return nil
+}
+
+func (s *memoryChatStore) Rename(ctx context.Context, id primitive.ObjectID, title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, ok := s.chats[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	chat.Title = title
+	s.chats[id] = chat
+	return nil
+}
+
+func (s *memoryChatStore) SetModel(ctx context.Context, id primitive.ObjectID, model string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, ok := s.chats[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	chat.Model = model
+	s.chats[id] = chat
+	return nil
+}
+
+func (s *memoryChatStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.chats[id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.chats, id)
+	return nil
+}
+
+func (s *memoryChatStore) BlobRefs(ctx context.Context) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	refs := make(map[string]int)
+	for _, chat := range s.chats {
+		for _, message := range chat.Messages {
+			for _, part := range message.Parts {
+				if part.Blob != "" {
+					refs[part.Blob]++
+				}
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+func (s *memoryChatStore) FileChats(ctx context.Context, userID primitive.ObjectID) (map[primitive.ObjectID][]Chat, error) {
+	chatList, err := s.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[primitive.ObjectID][]Chat)
+	for _, chat := range chatList {
+		attached := make(map[primitive.ObjectID]bool)
+		for _, message := range chat.Messages {
+			for _, part := range message.Parts {
+				if part.Type == PartFile && !part.FileID.IsZero() && !attached[part.FileID] {
+					attached[part.FileID] = true
+					refs[part.FileID] = append(refs[part.FileID], Chat{ID: chat.ID, Title: chat.Title})
+				}
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+func cloneChat(chat Chat) Chat {
+	chat.Messages = slices.Clone(chat.Messages)
+	return chat
+}
+
+func (s *memoryFileStore) Create(ctx context.Context, file *File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if file.ID.IsZero() {
+		file.ID = primitive.NewObjectID()
+	}
+
+	s.files[file.ID] = *file
+	return nil
+}
+
+func (s *memoryFileStore) Get(ctx context.Context, id primitive.ObjectID) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file, ok := s.files[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &file, nil
+}
+
+func (s *memoryFileStore) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var files []File
+	for _, file := range s.files {
+		if file.User == userID {
+			file.Text = ""
+			files = append(files, file)
+		}
+	}
+
+	slices.SortFunc(files, func(a, b File) int { return bytes.Compare(b.ID[:], a.ID[:]) })
+	return files, nil
+}
+
+func (s *memoryFileStore) Rename(ctx context.Context, id primitive.ObjectID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	file.Name = name
+	s.files[id] = file
+	return nil
+}
+
+func (s *memoryFileStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.files, id)
+	return nil
+}
+
+func (s *memoryFileStore) ByBlob(ctx context.Context, userID primitive.ObjectID, key string) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, file := range s.files {
+		if file.User == userID && file.Blob == key {
+			file.Text = ""
+			return &file, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *memoryFileStore) BlobRefs(ctx context.Context) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	refs := make(map[string]int)
+	for _, file := range s.files {
+		if file.Blob != "" {
+			refs[file.Blob]++
+		}
+		if file.Thumbnail != "" {
+			refs[file.Thumbnail]++
+		}
+	}
+
+	return refs, nil
+}
+
+func (s *memoryFileStore) UserUsage(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total int64
+	for _, file := range s.files {
+		if file.User == userID {
+			total += file.Size
+		}
+	}
+
+	return total, nil
+}
+
+func (s *memoryFileStore) GroupUsage(ctx context.Context, group string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total int64
+	for _, file := range s.files {
+		if file.Group == group {
+			total += file.Size
+		}
+	}
+
+	return total, nil
+}
+
+func (s *memoryVerificationStore) Create(ctx context.Context, verification *Verification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if verification.ID.IsZero() {
+		verification.ID = primitive.NewObjectID()
+	}
+	if verification.CreatedAt.IsZero() {
+		verification.CreatedAt = time.Now()
+	}
+
+	s.verifications[verification.ID] = *verification
+	return nil
+}
+
+func (s *memoryVerificationStore) Get(ctx context.Context, id primitive.ObjectID) (*Verification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	verification, ok := s.verifications[id]
+	if !ok || verificationExpired(&verification) {
+		return nil, ErrNotFound
+	}
+
+	return &verification, nil
+}
+
+func (s *memoryVerificationStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.verifications[id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.verifications, id)
+	return nil
+}
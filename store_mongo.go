@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mongoUserStore struct {
+	c *mongo.Collection
+
+	// unindexed are the unique fields whose index existing duplicates kept
+	// ensureIndexes from creating, which Create checks itself.
+	unindexed []string
+}
+
+type mongoChatStore struct {
+	c *mongo.Collection
+}
+
+type mongoFileStore struct {
+	c *mongo.Collection
+}
+
+type mongoVerificationStore struct {
+	c *mongo.Collection
+}
+
+// ensureIndexes creates the indexes GeminUI relies on. Creating an index
+// that already exists is a no-op, so this runs on every startup. A unique
+// index that existing duplicates keep from being created is skipped, and the
+// duplicates logged; the fields of the skipped indexes are returned by
+// collection.
+func ensureIndexes(ctx context.Context, db *mongo.Database) (map[string][]string, error) {
+	indexes := map[string][]mongo.IndexModel{
+		"users": {
+			{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetName("email_unique").SetUnique(true)},
+			{Keys: bson.D{{Key: "studentID", Value: 1}}, Options: options.Index().SetName("studentID_unique").SetUnique(true)},
+		},
+		// ObjectIDs start with their creation time, so sorting by _id lists
+		// the sidebar newest first.
+		"chats": {
+			{Keys: bson.D{{Key: "user", Value: 1}, {Key: "_id", Value: -1}}, Options: options.Index().SetName("user_created")},
+		},
+		"uploads": {
+			{Keys: bson.D{{Key: "user", Value: 1}, {Key: "blob", Value: 1}}, Options: options.Index().SetName("user_blob")},
+			{Keys: bson.D{{Key: "group", Value: 1}}, Options: options.Index().SetName("group")},
+		},
+		"email-verification": {
+			{
+				Keys:    bson.D{{Key: "createdAt", Value: 1}},
+				Options: options.Index().SetName("createdAt_ttl").SetExpireAfterSeconds(int32(verificationLifetime.Seconds())),
+			},
+		},
+	}
+
+	skipped := make(map[string][]string)
+	for collection, models := range indexes {
+		c := db.Collection(collection)
+		for _, model := range models {
+			_, err := c.Indexes().CreateOne(ctx, model)
+			if mongo.IsDuplicateKeyError(err) {
+				// Deployments from before the index may already have
+				// duplicates, which only an admin can sort out. Until
+				// then, the store checks for new ones itself.
+				logDuplicates(ctx, c, model)
+				for _, key := range model.Keys.(bson.D) {
+					skipped[collection] = append(skipped[collection], key.Key)
+				}
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("creating %s indexes: %w", collection, err)
+			}
+		}
+	}
+
+	return skipped, nil
+}
+
+// logDuplicates logs the documents that keep a unique index from being
+// created.
+func logDuplicates(ctx context.Context, c *mongo.Collection, model mongo.IndexModel) {
+	keys := model.Keys.(bson.D)
+	group := bson.D{}
+	for _, key := range keys {
+		group = append(group, bson.E{Key: key.Key, Value: "$" + key.Key})
+	}
+
+	log.Printf("Not creating index %s on %s, which would have to be unique: resolve these duplicates and restart", *model.Options.Name, c.Name())
+
+	cursor, err := c.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": group, "ids": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	})
+	if err != nil {
+		log.Printf("Error listing duplicates: %v", err)
+		return
+	}
+
+	var duplicates []struct {
+		Value bson.M               `bson:"_id"`
+		IDs   []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		log.Printf("Error listing duplicates: %v", err)
+		return
+	}
+	for _, duplicate := range duplicates {
+		ids := make([]string, len(duplicate.IDs))
+		for i, id := range duplicate.IDs {
+			ids[i] = id.Hex()
+		}
+		log.Printf("  %v: %s", duplicate.Value, strings.Join(ids, ", "))
+	}
+}
+
+// duplicateError maps a unique index violation to a DuplicateError, using
+// the index names from ensureIndexes to tell which field was duplicated.
+func duplicateError(err error) error {
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+
+	for _, field := range []string{"email", "studentID"} {
+		if strings.Contains(err.Error(), field+"_unique") {
+			return &DuplicateError{Field: field}
+		}
+	}
+
+	return &DuplicateError{}
+}
+
+// findOne decodes the first document matching filter into v, mapping
+// mongo.ErrNoDocuments to ErrNotFound.
+func findOne(ctx context.Context, c *mongo.Collection, filter any, v any, opts ...*options.FindOneOptions) error {
+	err := c.FindOne(ctx, filter, opts...).Decode(v)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// checkMatched maps an update or delete that touched no documents to
+// ErrNotFound.
+func checkMatched(n int64) error {
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *mongoUserStore) Create(ctx context.Context, user *User) error {
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	if user.JTI == nil {
+		user.JTI = []string{}
+	}
+
+	// Without their unique index, the fields are checked before inserting.
+	// Unlike the index, this lets two sign-ups at once through.
+	for _, field := range s.unindexed {
+		value := user.Email
+		if field == "studentID" {
+			value = user.StudentID
+		}
+		n, err := s.c.CountDocuments(ctx, bson.M{field: value}, options.Count().SetLimit(1))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return &DuplicateError{Field: field}
+		}
+	}
+
+	_, err := s.c.InsertOne(ctx, user)
+	return duplicateError(err)
+}
+
+func (s *mongoUserStore) ByID(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	var user User
+	if err := findOne(ctx, s.c, bson.M{"_id": id}, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s *mongoUserStore) ByEmail(ctx context.Context, email string) (*User, error) {
+	var user User
+	if err := findOne(ctx, s.c, bson.M{"email": email}, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s *mongoUserStore) AddToken(ctx context.Context, email, jti string) error {
+	result, err := s.c.UpdateOne(
+		ctx,
+		bson.M{"email": email},
+		bson.D{
+			{Key: "$push", Value: bson.D{{Key: "jtis", Value: jti}}},
+			{Key: "$set", Value: bson.D{{Key: "emailVerified", Value: true}}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return checkMatched(result.MatchedCount)
+}
+
+func (s *mongoChatStore) Create(ctx context.Context, chat *Chat) error {
+	if chat.ID.IsZero() {
+		chat.ID = primitive.NewObjectID()
+	}
+	upgradeHistory(chat.Messages, chat.ID.Timestamp())
+	chat.SchemaVersion = chatSchemaVersion
+
+	_, err := s.c.InsertOne(ctx, chat)
+	return err
+}
+
+func (s *mongoChatStore) Get(ctx context.Context, id primitive.ObjectID) (*Chat, error) {
+	var chat Chat
+	if err := findOne(ctx, s.c, bson.M{"_id": id}, &chat); err != nil {
+		return nil, err
+	}
+
+	return &chat, nil
+}
+
+func (s *mongoChatStore) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]Chat, error) {
+	cursor, err := s.c.Find(
+		ctx,
+		bson.M{"user": userID},
+		options.Find().SetSort(bson.M{"_id": -1}).SetProjection(bson.M{"messages": 0, "history": 0}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var chatList []Chat
+	if err = cursor.All(ctx, &chatList); err != nil {
+		return nil, err
+	}
+
+	return chatList, nil
+}
+
+func (s *mongoChatStore) Newest(ctx context.Context, userID primitive.ObjectID) (*Chat, error) {
+	var chat Chat
+	if err := findOne(ctx, s.c, bson.M{"user": userID}, &chat, options.FindOne().SetSort(bson.M{"_id": -1})); err != nil {
+		return nil, err
+	}
+
+	return &chat, nil
+}
+
+func (s *mongoChatStore) UpdateMessages(ctx context.Context, id primitive.ObjectID, messages []Message, leaf primitive.ObjectID) error {
+	upgradeHistory(messages, id.Timestamp())
+	result, err := s.c.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set":   bson.M{"messages": messages, "leaf": leaf, "schemaVersion": chatSchemaVersion},
+		"$unset": bson.M{"history": ""},
+	})
+	if err != nil {
+		return err
+	}
+
+	return checkMatched(result.MatchedCount)
+}
+
+func (s *mongoChatStore) SetLeaf(ctx context.Context, id, leaf primitive.ObjectID) error {
+	result, err := s.c.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"leaf": leaf}})
+	if err != nil {
+		return err
+	}
+
+	return checkMatched(result.MatchedCount)
+}
+
+func (s *mongoChatStore) Rename(ctx context.Context, id primitive.ObjectID, title string) error {
+	result, err := s.c.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"title": title}})
+	if err != nil {
+		return err
+	}
+
+	return checkMatched(result.MatchedCount)
+}
+
+func (s *mongoChatStore) SetModel(ctx context.Context, id primitive.ObjectID, model string) error {
+	result, err := s.c.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"model": model}})
+	if err != nil {
+		return err
+	}
+
+	return checkMatched(result.MatchedCount)
+}
+
+func (s *mongoChatStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.c.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+
+	return checkMatched(result.DeletedCount)
+}
+
+// mongoAllMessages puts the messages of chats not yet migrated to schema
+// version 3, which are in their history, with the others' in messages.
+var mongoAllMessages = bson.D{{Key: "$project", Value: bson.M{
+	"title": 1,
+	"messages": bson.M{"$concatArrays": bson.A{
+		bson.M{"$ifNull": bson.A{"$messages", bson.A{}}},
+		bson.M{"$ifNull": bson.A{"$history", bson.A{}}},
+	}},
+}}}
+
+func (s *mongoChatStore) BlobRefs(ctx context.Context) (map[string]int, error) {
+	return countBlobRefs(ctx, s.c, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"messages.parts.blob": bson.M{"$exists": true}},
+			bson.M{"history.parts.blob": bson.M{"$exists": true}},
+		}}}},
+		mongoAllMessages,
+		{{Key: "$unwind", Value: "$messages"}},
+		{{Key: "$unwind", Value: "$messages.parts"}},
+		{{Key: "$match", Value: bson.M{"messages.parts.blob": bson.M{"$exists": true, "$ne": ""}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$messages.parts.blob", "count": bson.M{"$sum": 1}}}},
+	})
+}
+
+func (s *mongoChatStore) FileChats(ctx context.Context, userID primitive.ObjectID) (map[primitive.ObjectID][]Chat, error) {
+	cursor, err := s.c.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user": userID, "$or": bson.A{
+			bson.M{"messages.parts.fileID": bson.M{"$exists": true}},
+			bson.M{"history.parts.fileID": bson.M{"$exists": true}},
+		}}}},
+		mongoAllMessages,
+		{{Key: "$sort", Value: bson.M{"_id": -1}}},
+		{{Key: "$unwind", Value: "$messages"}},
+		{{Key: "$unwind", Value: "$messages.parts"}},
+		{{Key: "$match", Value: bson.M{"messages.parts.type": PartFile, "messages.parts.fileID": bson.M{"$exists": true}}}},
+		// $first keeps the chats sorted, $addToSet wouldn't.
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"file": "$messages.parts.fileID", "chat": "$_id"},
+			"title": bson.M{"$first": "$title"},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id.chat": -1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []struct {
+		Key struct {
+			File primitive.ObjectID `bson:"file"`
+			Chat primitive.ObjectID `bson:"chat"`
+		} `bson:"_id"`
+		Title string `bson:"title"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	refs := make(map[primitive.ObjectID][]Chat)
+	for _, result := range results {
+		refs[result.Key.File] = append(refs[result.Key.File], Chat{ID: result.Key.Chat, Title: result.Title})
+	}
+
+	return refs, nil
+}
+
+// countBlobRefs runs an aggregation that groups blob keys into _id and
+// count.
+func countBlobRefs(ctx context.Context, c *mongo.Collection, pipeline mongo.Pipeline) (map[string]int, error) {
+	cursor, err := c.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts []struct {
+		Key   string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]int)
+	for _, count := range counts {
+		refs[count.Key] = count.Count
+	}
+
+	return refs, nil
+}
+
+func (s *mongoFileStore) Create(ctx context.Context, file *File) error {
+	if file.ID.IsZero() {
+		file.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.c.InsertOne(ctx, file)
+	return err
+}
+
+func (s *mongoFileStore) Get(ctx context.Context, id primitive.ObjectID) (*File, error) {
+	var file File
+	if err := findOne(ctx, s.c, bson.M{"_id": id}, &file); err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+func (s *mongoFileStore) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]File, error) {
+	cursor, err := s.c.Find(ctx, bson.M{"user": userID}, options.Find().SetSort(bson.M{"_id": -1}).SetProjection(bson.M{"text": 0}))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []File
+	if err = cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (s *mongoFileStore) Rename(ctx context.Context, id primitive.ObjectID, name string) error {
+	result, err := s.c.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"name": name}})
+	if err != nil {
+		return err
+	}
+
+	return checkMatched(result.MatchedCount)
+}
+
+func (s *mongoFileStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.c.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+
+	return checkMatched(result.DeletedCount)
+}
+
+func (s *mongoFileStore) ByBlob(ctx context.Context, userID primitive.ObjectID, key string) (*File, error) {
+	var file File
+	if err := findOne(ctx, s.c, bson.M{"user": userID, "blob": key}, &file, options.FindOne().SetProjection(bson.M{"text": 0})); err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+func (s *mongoFileStore) BlobRefs(ctx context.Context) (map[string]int, error) {
+	return countBlobRefs(ctx, s.c, mongo.Pipeline{
+		// Thumbnails are blobs too.
+		{{Key: "$project", Value: bson.M{"keys": bson.A{"$blob", "$thumbnail"}}}},
+		{{Key: "$unwind", Value: "$keys"}},
+		{{Key: "$match", Value: bson.M{"keys": bson.M{"$type": "string", "$ne": ""}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$keys", "count": bson.M{"$sum": 1}}}},
+	})
+}
+
+func (s *mongoFileStore) UserUsage(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	return sumSizes(ctx, s.c, bson.M{"user": userID})
+}
+
+func (s *mongoFileStore) GroupUsage(ctx context.Context, group string) (int64, error) {
+	return sumSizes(ctx, s.c, bson.M{"group": group})
+}
+
+// sumSizes totals the size of the files matching filter.
+func sumSizes(ctx context.Context, c *mongo.Collection, filter bson.M) (int64, error) {
+	cursor, err := c.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$size"}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var totals []struct {
+		Total int64 `bson:"total"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil {
+		return 0, err
+	}
+	if len(totals) == 0 {
+		return 0, nil
+	}
+
+	return totals[0].Total, nil
+}
+
+func (s *mongoVerificationStore) Create(ctx context.Context, verification *Verification) error {
+	if verification.ID.IsZero() {
+		verification.ID = primitive.NewObjectID()
+	}
+	if verification.CreatedAt.IsZero() {
+		verification.CreatedAt = time.Now()
+	}
+
+	_, err := s.c.InsertOne(ctx, verification)
+	return err
+}
+
+func (s *mongoVerificationStore) Get(ctx context.Context, id primitive.ObjectID) (*Verification, error) {
+	var verification Verification
+	if err := findOne(ctx, s.c, bson.M{"_id": id}, &verification); err != nil {
+		return nil, err
+	}
+
+	// The TTL monitor only runs once a minute.
+	if verificationExpired(&verification) {
+		return nil, ErrNotFound
+	}
+
+	return &verification, nil
+}
+
+func (s *mongoVerificationStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.c.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+
+	return checkMatched(result.DeletedCount)
+}
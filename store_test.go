@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestDuplicateUsers(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := openSQL(ctx, "sqlite:"+filepath.Join(t.TempDir(), "geminui.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for name, store := range map[string]UserStore{"sql": &sqlUserStore{db: db}, "memory": newMemoryUserStore()} {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Create(ctx, &User{Email: "student@example.com", StudentID: "1"}); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				user    *User
+				field   string
+				message string
+			}{
+				{&User{Email: "student@example.com", StudentID: "2"}, "email", "A user with this email already exists"},
+				{&User{Email: "other@example.com", StudentID: "1"}, "studentID", "A user with this student ID already exists"},
+			}
+			for _, test := range tests {
+				err := store.Create(ctx, test.user)
+				var duplicate *DuplicateError
+				if !errors.As(err, &duplicate) || duplicate.Field != test.field {
+					t.Errorf("creating %+v got %v, want a duplicate %s", test.user, err, test.field)
+					continue
+				}
+				if message := duplicateUserMessage(duplicate); message != test.message {
+					t.Errorf("creating %+v shows %q, want %q", test.user, message, test.message)
+				}
+			}
+
+			if err := store.Create(ctx, &User{Email: "other@example.com", StudentID: "2"}); err != nil {
+				t.Errorf("creating a different user got %v", err)
+			}
+		})
+	}
+}